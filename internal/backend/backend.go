@@ -24,6 +24,7 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -44,13 +45,16 @@ type Backend struct {
 	authorizationKey string
 	userAgent        string
 
-	client *http.Client
+	client   *http.Client
+	throttle *throttle
+	// maxBodyBytes is the maximum size of a request body, or zero if there is no limit.
+	maxBodyBytes int64
 
 	*metrics
 }
 
 func New(clusterName string, cfg *config.Egress, reg prometheus.Registerer) *Backend {
-	return &Backend{
+	b := &Backend{
 		apiEndpoint:      cfg.SnykAPIBaseURL,
 		clusterName:      clusterName,
 		authorizationKey: cfg.SnykServiceAccountToken,
@@ -62,8 +66,12 @@ func New(clusterName string, cfg *config.Egress, reg prometheus.Registerer) *Bac
 			Timeout:   cfg.HTTPClientTimeout.Duration,
 		},
 
+		maxBodyBytes: cfg.Batching.MaxBytes,
+
 		metrics: newMetrics(reg),
 	}
+	b.throttle = newThrottle(cfg.RateLimit, b.throttledSeconds)
+	return b
 }
 
 const contentTypeJSON = "application/vnd.api+json"
@@ -91,20 +99,87 @@ func (b *Backend) SanityCheck(ctx context.Context) error {
 	return nil
 }
 
+// Upsert sends the resources to the backend. If the request is too large, the resources are split
+// in halves that are sent separately, until only single resources that are too large on their own
+// remain. Those are returned in an *OversizedError, after all other resources have been sent. If a
+// part fails after others have been sent, a *PartialError tells which resources have been sent.
 func (b *Backend) Upsert(ctx context.Context, requestID string, orgID string, resources []Resource) error {
+	sent, oversized, err := b.upsert(ctx, requestID, orgID, resources)
+	switch {
+	case err != nil && (len(sent) > 0 || len(oversized) > 0):
+		return &PartialError{Sent: sent, Oversized: oversized, Err: err}
+	case err != nil:
+		return err
+	case len(oversized) > 0:
+		return &OversizedError{Resources: oversized}
+	}
+	return nil
+}
+
+// upsert sends the resources, bisecting them if the request is too large. Returns the resources
+// that have been sent and the ones that are too large to be sent on their own, also if sending
+// another part of the resources failed.
+func (b *Backend) upsert(ctx context.Context, requestID string, orgID string, resources []Resource) (sent, oversized []Resource, err error) {
+	err = b.send(ctx, requestID, orgID, resources)
+	if err == nil {
+		return resources, nil, nil
+	}
+	if !isTooLarge(err) {
+		return nil, nil, err
+	}
+
+	logger := log.FromContext(ctx).WithValues("request_id", requestID)
+	if len(resources) == 1 {
+		res := resources[0]
+		logger.Error(err, "resource is too large to be sent", "resource", newResourceID(res.ManifestBlob).String())
+		b.errors.WithLabelValues(strconv.Itoa(http.StatusRequestEntityTooLarge)).Inc()
+		// the resource is not retried, so an earlier failure of it must not be kept either. Like
+		// for deletions, recordSuccess does the required cleanup.
+		b.recordSuccess(ctx, res.ManifestBlob)
+		return nil, resources, nil
+	}
+
+	logger.Info("splitting batch that is too large", "batch_size", len(resources))
+	half := len(resources) / 2
+	for _, part := range [][]Resource{resources[:half], resources[half:]} {
+		s, o, err := b.upsert(ctx, requestID, orgID, part)
+		sent = append(sent, s...)
+		oversized = append(oversized, o...)
+		if err != nil {
+			return sent, oversized, err
+		}
+	}
+	return sent, oversized, nil
+}
+
+// send sends the resources in a single request.
+func (b *Backend) send(ctx context.Context, requestID string, orgID string, resources []Resource) error {
 	body, err := b.newPostBody(resources)
+	if errors.Is(err, errRequestTooLarge) {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("could not construct request body: %w", err)
 	}
 
 	if _, err := b.do(ctx, http.MethodPost, orgID, requestID, body); err != nil {
+		if isTooLarge(err) {
+			// the failure is recorded once the resources that are too large have been isolated.
+			return fmt.Errorf("could not post resource: %w", err)
+		}
+
 		var httpErr *HTTPError
 		var transportErr *transportError
+		var throttledErr *ThrottledError
 		switch {
 		case errors.As(err, &transportErr):
 			for _, resource := range resources {
 				b.recordFailure(ctx, 0, resource.ManifestBlob, resource.DeletedAt)
 			}
+		case errors.As(err, &throttledErr):
+			for _, resource := range resources {
+				b.recordFailure(ctx, http.StatusTooManyRequests, resource.ManifestBlob, resource.DeletedAt)
+			}
 		case errors.As(err, &httpErr):
 			for _, resource := range resources {
 				b.recordFailure(ctx, httpErr.StatusCode, resource.ManifestBlob, resource.DeletedAt)
@@ -129,6 +204,10 @@ func (b *Backend) do(ctx context.Context, method, orgID, requestID string, body
 		return nil, fmt.Errorf("could not construct HTTP request: %w", err)
 	}
 
+	if err := b.throttle.wait(ctx, orgID); err != nil {
+		return nil, err
+	}
+
 	req.Header.Add("Content-Type", contentTypeJSON)
 	req.Header.Add("Authorization", "token "+b.authorizationKey)
 	req.Header.Add("snyk-request-id", requestID)
@@ -140,9 +219,14 @@ func (b *Backend) do(ctx context.Context, method, orgID, requestID string, body
 	}
 
 	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
-		return nil, newHTTPError(resp)
+		httpErr := newHTTPError(resp)
+		if retryAfter := httpErr.RetryAfter(); resp.StatusCode == http.StatusTooManyRequests || retryAfter > 0 {
+			b.throttle.throttled(orgID, retryAfter)
+		}
+		return nil, httpErr
 	}
 
+	b.throttle.succeeded(orgID)
 	return resp.Body, nil
 }
 
@@ -175,7 +259,88 @@ func (t *transportError) Error() string {
 	return fmt.Sprintf("HTTP transport error: %v", t.err)
 }
 
-func newHTTPError(resp *http.Response) error {
+// errRequestTooLarge is returned if a request body exceeds the configured limit.
+var errRequestTooLarge = errors.New("request too large")
+
+// isTooLarge returns true if the request failed because its body is too large.
+func isTooLarge(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusRequestEntityTooLarge {
+		return true
+	}
+	return errors.Is(err, errRequestTooLarge)
+}
+
+// OversizedError is returned if resources could not be sent as they are too large on their own.
+// All other resources of the batch have been sent.
+type OversizedError struct {
+	Resources []Resource
+}
+
+func (e *OversizedError) Error() string {
+	ids := make([]string, len(e.Resources))
+	for i, res := range e.Resources {
+		ids[i] = newResourceID(res.ManifestBlob).String()
+	}
+	return fmt.Sprintf("%d resources are too large to be sent: %v", len(e.Resources), strings.Join(ids, ", "))
+}
+
+// Contains returns true if the given object is one of the resources that are too large.
+func (e *OversizedError) Contains(obj client.Object) bool {
+	id := newResourceID(obj)
+	for _, res := range e.Resources {
+		if newResourceID(res.ManifestBlob) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// PartialError is returned if a batch has been split and one of its parts could not be sent after
+// others have been. All resources that are neither part of Sent nor Oversized failed with Err.
+type PartialError struct {
+	// Sent are the resources that have been sent.
+	Sent []Resource
+	// Oversized are the resources that are too large to be sent on their own.
+	Oversized []Resource
+	Err       error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("only %d resources have been sent and %d are too large to be sent: %v",
+		len(e.Sent), len(e.Oversized), e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable returns true if a request that failed with the given error might succeed when it is
+// retried. Requests are not retried if the backend rejected them as invalid, unauthorized or too
+// large, or if the organization does not exist.
+func Retryable(err error) bool {
+	var oversized *OversizedError
+	if errors.As(err, &oversized) {
+		return false
+	}
+
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		// transport errors and others are likely temporary.
+		return true
+	}
+
+	switch httpErr.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestEntityTooLarge:
+		return false
+	default:
+		// this includes 429 and 5xx.
+		return true
+	}
+}
+
+func newHTTPError(resp *http.Response) *HTTPError {
 	body, err := io.ReadAll(resp.Body)
 	return &HTTPError{
 		StatusCode: resp.StatusCode,
@@ -236,6 +401,10 @@ func (b *Backend) newPostBody(resources []Resource) (io.Reader, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not marshal request body: %w", err)
 	}
+	if b.maxBodyBytes > 0 && int64(len(body)) > b.maxBodyBytes {
+		return nil, fmt.Errorf("request body of %d bytes exceeds the limit of %d bytes: %w",
+			len(body), b.maxBodyBytes, errRequestTooLarge)
+	}
 
 	return bytes.NewReader(body), nil
 }
@@ -288,6 +457,10 @@ type resourceIdentifier struct {
 	types.NamespacedName
 }
 
+func (r resourceIdentifier) String() string {
+	return fmt.Sprintf("%v %v", r.GroupVersionKind, r.NamespacedName)
+}
+
 func newResourceID(from client.Object) resourceIdentifier {
 	return resourceIdentifier{
 		GroupVersionKind: from.GetObjectKind().GroupVersionKind(),
@@ -308,6 +481,7 @@ type metrics struct {
 	errors                 *prometheus.CounterVec
 	oldestFailureTimestamp prometheus.Gauge
 	oldestFailureAge       *prometheus.Desc
+	throttledSeconds       *prometheus.CounterVec
 }
 
 var retriesBuckets = []float64{1, 2, 3, 5, 10, 50}
@@ -351,6 +525,14 @@ func newMetrics(registry prometheus.Registerer) *metrics {
 			"Age of the first failed reconciliation of the oldest unreconciled resource in seconds",
 			nil, nil,
 		),
+		throttledSeconds: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "kubernetes_scanner",
+				Name:      "backend_throttled_seconds_total",
+				Help:      "Time that requests to the backend have been delayed or paused due to throttling, partitioned by the reason",
+			},
+			[]string{"reason"},
+		),
 	}
 
 	registry.MustRegister(m)
@@ -455,6 +637,7 @@ func (m *metrics) Collect(ch chan<- prometheus.Metric) {
 	m.retriesTotal.Collect(ch)
 	m.retries.Collect(ch)
 	m.errors.Collect(ch)
+	m.throttledSeconds.Collect(ch)
 }
 
 func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
@@ -464,4 +647,5 @@ func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
 	m.retriesTotal.Describe(ch)
 	m.retries.Describe(ch)
 	m.errors.Describe(ch)
+	m.throttledSeconds.Describe(ch)
 }
@@ -29,6 +29,7 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	promclient "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
@@ -101,6 +102,174 @@ func TestBackendErrorHandling(t *testing.T) {
 	require.Equal(t, 400, h.StatusCode)
 }
 
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "bad request", err: &HTTPError{StatusCode: 400}, retryable: false},
+		{name: "unauthorized", err: &HTTPError{StatusCode: 401}, retryable: false},
+		{name: "forbidden", err: &HTTPError{StatusCode: 403}, retryable: false},
+		{name: "not found", err: &HTTPError{StatusCode: 404}, retryable: false},
+		{name: "too many requests", err: &HTTPError{StatusCode: 429}, retryable: true},
+		{name: "internal server error", err: &HTTPError{StatusCode: 500}, retryable: true},
+		{name: "service unavailable", err: &HTTPError{StatusCode: 503}, retryable: true},
+		{name: "transport error", err: &transportError{fmt.Errorf("connection refused")}, retryable: true},
+		{
+			name:      "wrapped",
+			err:       fmt.Errorf("could not post resource: %w", &HTTPError{StatusCode: 403}),
+			retryable: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.retryable, Retryable(tc.err))
+		})
+	}
+}
+
+func TestBackendThrottling(t *testing.T) {
+	const orgID = "org-123"
+	ctx := context.Background()
+	tu := testUpstream{t: t, preferredVersion: "v1", orgID: orgID, auth: testToken, statusCodeToReturn: 429, retryAfter: "120"}
+	ts := httptest.NewServer(&tu)
+	defer ts.Close()
+
+	b := New("my-pet-cluster", &config.Egress{
+		HTTPClientTimeout:       metav1.Duration{Duration: 1 * time.Second},
+		SnykAPIBaseURL:          ts.URL,
+		SnykServiceAccountToken: testToken,
+		RateLimit:               config.RateLimit{RequestsPerSecond: 10, MinRequestsPerSecond: 1, Burst: 1},
+	}, prometheus.NewPedanticRegistry())
+
+	err := b.Upsert(ctx, "req-id", orgID, []Resource{{pod, "v1", metav1.Time{Time: now()}, nil}})
+	var h *HTTPError
+	require.ErrorAs(t, err, &h)
+	require.Equal(t, 429, h.StatusCode)
+
+	// requests to the organization are paused now, without sending them.
+	tu.statusCodeToReturn = 0
+	err = b.Upsert(ctx, "req-id", orgID, []Resource{{pod, "v1", metav1.Time{Time: now()}, nil}})
+	var throttled *ThrottledError
+	require.ErrorAs(t, err, &throttled)
+	require.Equal(t, 120*time.Second, throttled.RetryAfter())
+	require.Equal(t, float64(120), testutil.ToFloat64(b.throttledSeconds.WithLabelValues("retry_after")))
+}
+
+func TestBackendSplitsLargeBatches(t *testing.T) {
+	large := newResource("large")
+	large.SetAnnotations(map[string]string{"data": strings.Repeat("x", 5000)})
+
+	for _, tc := range []struct {
+		name string
+		// serverLimit is the body size above which the backend responds with 413.
+		serverLimit int
+		// maxBytes is the configured limit of the request body.
+		maxBytes int64
+		requests int
+	}{
+		{
+			name:        "backend rejects large requests",
+			serverLimit: 3000,
+			// the whole batch, both halves, and both halves of the half with the large resource.
+			requests: 5,
+		},
+		{
+			name:     "configured limit",
+			maxBytes: 3000,
+			// the large resource is never sent.
+			requests: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var lock sync.Mutex
+			var received []string
+			requests := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+
+				lock.Lock()
+				defer lock.Unlock()
+				requests++
+				if tc.serverLimit > 0 && len(body) > tc.serverLimit {
+					http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+
+				req := request{}
+				require.NoError(t, json.Unmarshal(body, &req))
+				for _, res := range req.Data.Attributes.Resources {
+					received = append(received, res.ManifestBlob.GetName())
+				}
+			}))
+			defer ts.Close()
+
+			b := New("my-pet-cluster", &config.Egress{
+				HTTPClientTimeout:       metav1.Duration{Duration: 1 * time.Second},
+				SnykAPIBaseURL:          ts.URL,
+				SnykServiceAccountToken: testToken,
+				Batching:                config.Batching{MaxBytes: tc.maxBytes},
+			}, prometheus.NewPedanticRegistry())
+
+			var resources []Resource
+			for _, obj := range []client.Object{newResource("a"), newResource("b"), large, newResource("c")} {
+				resources = append(resources, Resource{obj, "v1", metav1.Time{Time: now()}, nil})
+			}
+			err := b.Upsert(context.Background(), "req-id", "org-123", resources)
+
+			var oversized *OversizedError
+			require.ErrorAs(t, err, &oversized)
+			require.Len(t, oversized.Resources, 1)
+			require.True(t, oversized.Contains(large))
+			require.False(t, oversized.Contains(newResource("a")))
+			require.False(t, Retryable(err))
+
+			require.ElementsMatch(t, []string{"a", "b", "c"}, received, "all other resources should be sent")
+			require.Equal(t, tc.requests, requests)
+			_, ok := b.failures[newResourceID(large)]
+			require.False(t, ok, "the large resource should not be retried")
+			require.Equal(t, float64(1), testutil.ToFloat64(b.errors.WithLabelValues("413")))
+		})
+	}
+}
+
+func TestBackendReportsPartiallySentBatches(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		resources := req.Data.Attributes.Resources
+		switch {
+		case len(resources) > 2:
+			http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		case resources[len(resources)-1].ManifestBlob.GetName() == "d":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	b := New("my-pet-cluster", &config.Egress{
+		HTTPClientTimeout:       metav1.Duration{Duration: 1 * time.Second},
+		SnykAPIBaseURL:          ts.URL,
+		SnykServiceAccountToken: testToken,
+	}, prometheus.NewPedanticRegistry())
+
+	var resources []Resource
+	for _, name := range []string{"a", "b", "c", "d"} {
+		resources = append(resources, Resource{newResource(name), "v1", metav1.Time{Time: now()}, nil})
+	}
+	err := b.Upsert(context.Background(), "req-id", "org-123", resources)
+
+	var partial *PartialError
+	require.ErrorAs(t, err, &partial)
+	require.Equal(t, resources[:2], partial.Sent, "the first half should have been sent")
+	require.Empty(t, partial.Oversized)
+	var httpErr *HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	require.Equal(t, http.StatusServiceUnavailable, httpErr.StatusCode)
+	require.True(t, Retryable(err))
+}
+
 func TestMetricsFromBackend(t *testing.T) {
 	const orgID = "org-123"
 	ctx := context.Background()
@@ -155,6 +324,7 @@ type testUpstream struct {
 	expectDeletion     bool
 	auth               string
 	statusCodeToReturn int
+	retryAfter         string
 }
 
 func (tu *testUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -188,6 +358,9 @@ func (tu *testUpstream) handleKubernetesResources(w http.ResponseWriter, r *http
 	}
 
 	if tu.statusCodeToReturn != 0 {
+		if tu.retryAfter != "" {
+			w.Header().Set("Retry-After", tu.retryAfter)
+		}
 		http.Error(w, "an error occurred", tu.statusCodeToReturn)
 		return
 	}
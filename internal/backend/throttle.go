@@ -0,0 +1,198 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+// throttle limits the rate of requests to the backend per organization. Whenever the backend
+// throttles requests to an organization, its rate is halved down to the minimum, and recovers
+// gradually with every successful request. Organizations that are not limited start out at the
+// burst instead. If the backend asks to retry after some time, no requests are sent to the
+// organization until then.
+type throttle struct {
+	max   rate.Limit
+	min   rate.Limit
+	burst int
+
+	lock sync.Mutex
+	orgs map[string]*orgThrottle
+
+	throttledSeconds *prometheus.CounterVec
+}
+
+type orgThrottle struct {
+	limiter *rate.Limiter
+	// pausedUntil is the time until which no requests are sent, as requested by the backend.
+	pausedUntil time.Time
+}
+
+// newThrottle creates a throttle with the given settings. A zero rate does not limit requests
+// until the backend throttles them.
+func newThrottle(cfg config.RateLimit, throttledSeconds *prometheus.CounterVec) *throttle {
+	t := &throttle{
+		max:              rate.Limit(cfg.RequestsPerSecond),
+		min:              rate.Limit(cfg.MinRequestsPerSecond),
+		burst:            cfg.Burst,
+		orgs:             map[string]*orgThrottle{},
+		throttledSeconds: throttledSeconds,
+	}
+	if t.max <= 0 {
+		t.max = rate.Inf
+	}
+	return t
+}
+
+// ceiling returns the highest finite rate of organizations. Unlimited organizations are lowered
+// from the burst per second, as halving an infinite rate would not lower it at all.
+func (t *throttle) ceiling() rate.Limit {
+	if t.max == rate.Inf {
+		return rate.Limit(max(t.burst, 1))
+	}
+	return t.max
+}
+
+// org returns the throttle of the given organization. t.lock must be held.
+func (t *throttle) org(orgID string) *orgThrottle {
+	o, ok := t.orgs[orgID]
+	if !ok {
+		o = &orgThrottle{limiter: rate.NewLimiter(t.max, t.burst)}
+		t.orgs[orgID] = o
+	}
+	return o
+}
+
+// wait blocks until a request may be sent to the given organization. Returns a *ThrottledError
+// right away if requests to the organization are paused.
+func (t *throttle) wait(ctx context.Context, orgID string) error {
+	t.lock.Lock()
+	o := t.org(orgID)
+	pausedUntil := o.pausedUntil
+	t.lock.Unlock()
+
+	if now().Before(pausedUntil) {
+		return &ThrottledError{Until: pausedUntil}
+	}
+
+	n := now()
+	r := o.limiter.ReserveN(n, 1)
+	if !r.OK() {
+		return fmt.Errorf("could not wait for rate limit: burst of %d is exceeded", t.burst)
+	}
+	delay := r.DelayFrom(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		// the reserved request is not sent, so it shouldn't count against the rate.
+		r.CancelAt(now())
+		return fmt.Errorf("could not wait for rate limit: %w", ctx.Err())
+	case <-timer.C:
+	}
+	t.throttledSeconds.WithLabelValues("rate_limit").Add(delay.Seconds())
+	return nil
+}
+
+// throttled lowers the rate of the given organization after the backend throttled a request to it,
+// and pauses all requests to it for the given duration.
+func (t *throttle) throttled(orgID string, retryAfter time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	o := t.org(orgID)
+	limit := min(o.limiter.Limit(), t.ceiling())
+	o.limiter.SetLimitAt(now(), max(limit/2, t.min))
+
+	n := now()
+	until := n.Add(retryAfter)
+	if !until.After(o.pausedUntil) {
+		return
+	}
+	// only the time that requests are paused in addition to an earlier pause is counted.
+	from := o.pausedUntil
+	if n.After(from) {
+		from = n
+	}
+	if paused := until.Sub(from); paused > 0 {
+		t.throttledSeconds.WithLabelValues("retry_after").Add(paused.Seconds())
+	}
+	o.pausedUntil = until
+}
+
+// succeeded raises the rate of the given organization after a successful request, by a twentieth
+// of the ceiling. Once the ceiling is reached, unlimited organizations are not limited anymore.
+func (t *throttle) succeeded(orgID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	o := t.org(orgID)
+	limit := o.limiter.Limit()
+	if limit >= t.max {
+		return
+	}
+	ceiling := t.ceiling()
+	if limit += ceiling / 20; limit >= ceiling {
+		limit = t.max
+	}
+	o.limiter.SetLimitAt(now(), limit)
+}
+
+// ThrottledError is returned if a request has not been sent, as the backend asked to not send
+// requests to the organization until some time has passed.
+type ThrottledError struct {
+	Until time.Time
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("requests are paused until %v as requested by the backend", e.Until.Format(time.RFC3339))
+}
+
+// RetryAfter returns the time until requests are sent again.
+func (e *ThrottledError) RetryAfter() time.Duration {
+	return e.Until.Sub(now())
+}
+
+// RetryAfter returns the time after which the backend asked the request to be retried, as set in
+// the Retry-After header either in seconds or as a date. Returns zero if the header is not set.
+func (h *HTTPError) RetryAfter() time.Duration {
+	value := h.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now()), 0)
+	}
+	return 0
+}
@@ -0,0 +1,144 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package backend
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+func newTestThrottle() *throttle {
+	return newThrottle(config.RateLimit{RequestsPerSecond: 10, MinRequestsPerSecond: 2, Burst: 1},
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: "throttled"}, []string{"reason"}))
+}
+
+func TestThrottleRate(t *testing.T) {
+	th := newTestThrottle()
+	limit := func() rate.Limit { return th.orgs["org"].limiter.Limit() }
+
+	th.succeeded("org")
+	require.Equal(t, rate.Limit(10), limit(), "the rate should never exceed the maximum")
+
+	th.throttled("org", 0)
+	require.Equal(t, rate.Limit(5), limit())
+	th.throttled("org", 0)
+	th.throttled("org", 0)
+	require.Equal(t, rate.Limit(2), limit(), "the rate should never fall below the minimum")
+
+	th.succeeded("org")
+	require.Equal(t, rate.Limit(2.5), limit(), "the rate should recover gradually")
+	require.NotContains(t, th.orgs, "other", "organizations should be throttled independently")
+	require.NoError(t, th.wait(context.Background(), "other"))
+	require.Equal(t, rate.Limit(10), th.orgs["other"].limiter.Limit())
+}
+
+func TestThrottlePause(t *testing.T) {
+	th := newTestThrottle()
+	ctx := context.Background()
+	require.NoError(t, th.wait(ctx, "org"))
+
+	th.throttled("org", time.Minute)
+	err := th.wait(ctx, "org")
+	var throttled *ThrottledError
+	require.ErrorAs(t, err, &throttled)
+	require.Equal(t, time.Minute, throttled.RetryAfter())
+
+	// overlapping pauses are only counted once.
+	th.throttled("org", 30*time.Second)
+	th.throttled("org", 2*time.Minute)
+	require.Equal(t, float64(120), testutil.ToFloat64(th.throttledSeconds.WithLabelValues("retry_after")))
+
+	require.NoError(t, th.wait(ctx, "other"), "other organizations should not be paused")
+}
+
+func TestThrottleWait(t *testing.T) {
+	th := newTestThrottle()
+	ctx := context.Background()
+
+	// the clock is frozen during tests, so the second request has to wait for the full interval.
+	require.NoError(t, th.wait(ctx, "org"))
+	require.NoError(t, th.wait(ctx, "org"))
+	require.InDelta(t, 0.1, testutil.ToFloat64(th.throttledSeconds.WithLabelValues("rate_limit")), 0.001)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, th.wait(canceled, "org"), context.Canceled)
+
+	unlimited := newThrottle(config.RateLimit{MinRequestsPerSecond: 0.1, Burst: 10}, th.throttledSeconds)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, unlimited.wait(canceled, "org"), "requests should not be limited")
+	}
+}
+
+func TestThrottleUnlimited(t *testing.T) {
+	// the default rate limit, which does not limit the rate.
+	th := newThrottle(config.RateLimit{MinRequestsPerSecond: 0.1, Burst: 10},
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: "throttled"}, []string{"reason"}))
+	limit := func() rate.Limit { return th.orgs["org"].limiter.Limit() }
+	ctx := context.Background()
+
+	require.NoError(t, th.wait(ctx, "org"))
+	require.Equal(t, rate.Inf, limit())
+
+	// a 429 without a Retry-After header.
+	th.throttled("org", 0)
+	require.Equal(t, rate.Limit(5), limit(), "the rate should be lowered from the burst")
+	for i := 0; i < 11; i++ {
+		require.NoError(t, th.wait(ctx, "org"))
+	}
+	require.InDelta(t, 0.2, testutil.ToFloat64(th.throttledSeconds.WithLabelValues("rate_limit")), 0.001,
+		"the request after the burst should be delayed")
+
+	th.throttled("org", 0)
+	require.Equal(t, rate.Limit(2.5), limit())
+	for i := 0; i < 14; i++ {
+		th.succeeded("org")
+	}
+	require.Equal(t, rate.Limit(9.5), limit(), "the rate should recover gradually")
+	th.succeeded("org")
+	require.Equal(t, rate.Inf, limit(), "the rate should not be limited once recovered")
+}
+
+func TestHTTPErrorRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		header     string
+		retryAfter time.Duration
+	}{
+		{name: "missing", header: "", retryAfter: 0},
+		{name: "seconds", header: "120", retryAfter: 2 * time.Minute},
+		{name: "date", header: now().Add(time.Hour).UTC().Format(http.TimeFormat), retryAfter: time.Hour},
+		{name: "date in the past", header: now().Add(-time.Hour).UTC().Format(http.TimeFormat), retryAfter: 0},
+		{name: "invalid", header: "soon", retryAfter: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &HTTPError{StatusCode: 429, Header: http.Header{}}
+			if tc.header != "" {
+				h.Header.Set("Retry-After", tc.header)
+			}
+			require.Equal(t, tc.retryAfter, h.RetryAfter())
+		})
+	}
+}
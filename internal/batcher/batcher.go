@@ -7,12 +7,18 @@ import (
 )
 
 type Config[K comparable, V any] struct {
-	Context      context.Context
 	MaxBatchSize int
 	Interval     time.Duration
-	Process      func(context.Context, K, []V)
+	// Process processes a batch of values of the given key. It returns an error if the batch could
+	// not be processed.
+	Process func(context.Context, K, []V) error
+	// Done is called for every value of a batch once the batch has been processed, with the error
+	// returned by Process. It is optional.
+	Done func(K, V, error)
 }
 
+// Batcher collects queued values per key and processes them in batches. It implements
+// controller-runtime's Runnable interface; batches are only processed once Start has been called.
 type Batcher[K comparable, V any] struct {
 	config Config[K, V]
 	lock   *sync.Mutex
@@ -20,41 +26,54 @@ type Batcher[K comparable, V any] struct {
 }
 
 func NewBatcher[K comparable, V any](config Config[K, V]) *Batcher[K, V] {
-	b := &Batcher[K, V]{
+	return &Batcher[K, V]{
 		config: config,
 		lock:   &sync.Mutex{},
 		queue:  map[K][]V{},
 	}
+}
 
-	if b.config.Context == nil {
-		b.config.Context = context.Background()
-	}
+// Start processes the queue every interval until the given context is done.
+func (b *Batcher[K, V]) Start(ctx context.Context) error {
+	ticker := time.NewTicker(b.config.Interval)
+	defer ticker.Stop()
 
-	go func() {
-		for {
-			// Wait until next iteration.
-			time.Sleep(config.Interval)
+	for {
+		// Wait until next iteration.
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
 
-			// Lock, and then create a new queue, we're going to process the old
-			// queue.
-			b.lock.Lock()
-			processing := b.queue
-			b.queue = map[K][]V{}
-			b.lock.Unlock()
+		// Lock, and then create a new queue, we're going to process the old
+		// queue.
+		b.lock.Lock()
+		processing := b.queue
+		b.queue = map[K][]V{}
+		b.lock.Unlock()
 
-			// Process items per key, respecting MaxBatchSize.
-			for key, items := range processing {
-				for i := 0; i < len(items); i += config.MaxBatchSize {
-					batch := items[i:min(i+config.MaxBatchSize, len(items))]
-					if len(batch) > 0 {
-						config.Process(b.config.Context, key, batch)
+		// Process items per key, respecting MaxBatchSize.
+		for key, items := range processing {
+			for i := 0; i < len(items); i += b.config.MaxBatchSize {
+				batch := items[i:min(i+b.config.MaxBatchSize, len(items))]
+				if len(batch) == 0 {
+					continue
+				}
+				err := b.config.Process(ctx, key, batch)
+				if b.config.Done != nil {
+					for _, value := range batch {
+						b.config.Done(key, value, err)
 					}
 				}
 			}
 		}
-	}()
+	}
+}
 
-	return b
+// NeedLeaderElection ensures that only the elected leader is processing batches.
+func (b *Batcher[K, V]) NeedLeaderElection() bool {
+	return true
 }
 
 func (b *Batcher[K, V]) Queue(key K, value V) {
@@ -2,6 +2,7 @@ package batcher_test
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -36,10 +37,12 @@ func TestBatcherMaxBatchSize(t *testing.T) {
 		processed[input[i]] = 0
 	}
 	lock := sync.Mutex{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	b := batcher.NewBatcher[org, thing](batcher.Config[org, thing]{
 		MaxBatchSize: 10,
 		Interval:     time.Duration(100 * time.Millisecond),
-		Process: func(ctx context.Context, k org, batch []thing) {
+		Process: func(ctx context.Context, k org, batch []thing) error {
 			lock.Lock()
 			if firstBatch == nil {
 				firstBatch = batch
@@ -48,8 +51,10 @@ func TestBatcherMaxBatchSize(t *testing.T) {
 				processed[batch[i]] += 1
 			}
 			lock.Unlock()
+			return nil
 		},
 	})
+	go b.Start(ctx)
 	for _, item := range input {
 		b.Queue(org{"foo"}, item)
 	}
@@ -71,10 +76,12 @@ func TestBatcherInterval(t *testing.T) {
 		processed[input[i]] = 0
 	}
 	lock := sync.Mutex{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	b := batcher.NewBatcher[org, thing](batcher.Config[org, thing]{
 		MaxBatchSize: 10,
 		Interval:     time.Duration(100 * time.Millisecond),
-		Process: func(ctx context.Context, k org, batch []thing) {
+		Process: func(ctx context.Context, k org, batch []thing) error {
 			lock.Lock()
 			if firstBatch == nil {
 				firstBatch = batch
@@ -83,8 +90,10 @@ func TestBatcherInterval(t *testing.T) {
 				processed[batch[i]] += 1
 			}
 			lock.Unlock()
+			return nil
 		},
 	})
+	go b.Start(ctx)
 	go func() {
 		for _, item := range input {
 			b.Queue(org{"foo"}, item)
@@ -99,13 +108,78 @@ func TestBatcherInterval(t *testing.T) {
 
 func TestBatcherNoZeroBatches(t *testing.T) {
 	called := false
-	batcher.NewBatcher[org, thing](batcher.Config[org, thing]{
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := batcher.NewBatcher[org, thing](batcher.Config[org, thing]{
 		MaxBatchSize: 10,
 		Interval:     time.Duration(10 * time.Millisecond),
-		Process: func(ctx context.Context, k org, batch []thing) {
+		Process: func(ctx context.Context, k org, batch []thing) error {
 			called = true
+			return nil
 		},
 	})
+	go b.Start(ctx)
 	time.Sleep(30 * time.Millisecond)
 	require.False(t, called)
 }
+
+func TestBatcherNotStarted(t *testing.T) {
+	// Batches must only be processed once the batcher is started, e.g. when this replica has been
+	// elected as the leader.
+	called := false
+	b := batcher.NewBatcher[org, thing](batcher.Config[org, thing]{
+		MaxBatchSize: 10,
+		Interval:     time.Duration(10 * time.Millisecond),
+		Process: func(ctx context.Context, k org, batch []thing) error {
+			called = true
+			return nil
+		},
+	})
+	b.Queue(org{"foo"}, thing{1})
+	time.Sleep(30 * time.Millisecond)
+	require.False(t, called)
+}
+
+func TestBatcherStop(t *testing.T) {
+	b := batcher.NewBatcher[org, thing](batcher.Config[org, thing]{
+		MaxBatchSize: 10,
+		Interval:     time.Duration(10 * time.Millisecond),
+		Process:      func(ctx context.Context, k org, batch []thing) error { return nil },
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.Start(ctx) }()
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestBatcherDone(t *testing.T) {
+	errFailed := errors.New("failed")
+	done := make(chan error, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := batcher.NewBatcher[org, thing](batcher.Config[org, thing]{
+		MaxBatchSize: 2,
+		Interval:     time.Duration(10 * time.Millisecond),
+		Process: func(ctx context.Context, k org, batch []thing) error {
+			if len(batch) == 1 {
+				return errFailed
+			}
+			return nil
+		},
+		Done: func(k org, value thing, err error) {
+			done <- err
+		},
+	})
+	for _, item := range generate(3) {
+		b.Queue(org{"foo"}, item)
+	}
+	go b.Start(ctx)
+
+	// every value is completed with the result of its batch.
+	var errs []error
+	for i := 0; i < 3; i++ {
+		errs = append(errs, <-done)
+	}
+	require.Equal(t, []error{nil, nil, errFailed}, errs)
+}
@@ -16,9 +16,11 @@
 package config
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -26,6 +28,8 @@ import (
 	"golang.org/x/exp/slices"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/yaml"
@@ -55,8 +59,35 @@ type Config struct {
 
 	Logging Logging `json:"logging"`
 
+	// LeaderElection configures leader election between multiple replicas of the scanner. Only the
+	// elected leader is scanning and sending resources, the other replicas are on standby.
+	LeaderElection LeaderElection `json:"leaderElection"`
+
+	// Sharding distributes the scanned namespaces between multiple replicas of the scanner, where
+	// each replica is active and only scans the namespaces it owns. Cannot be combined with leader
+	// election.
+	Sharding Sharding `json:"sharding"`
+
+	// NamespaceScope restricts the scanner to a fixed list of namespaces, so that it can be
+	// installed with namespaced Roles only, without any cluster-wide permissions.
+	NamespaceScope NamespaceScope `json:"namespaceScope"`
+
+	// RoutingState persists the organizations that each resource has been sent to, so that
+	// resources are deleted from organizations they are not routed to anymore, even if the routes
+	// changed while the scanner was not running.
+	RoutingState RoutingState `json:"routingState"`
+
+	// ReloadInterval defines how often the config file is checked for changes. Changes to the scan
+	// types and routes are applied without restarting the scanner, all other settings require a
+	// restart. Setting it to zero disables reloading.
+	ReloadInterval metav1.Duration `json:"reloadInterval"`
+
 	Scheme     *runtime.Scheme `json:"-"`
 	RestConfig *rest.Config    `json:"-"`
+
+	// path is the file the config has been read from and checksum the checksum of its contents.
+	path     string
+	checksum [sha256.Size]byte
 }
 
 type Egress struct {
@@ -73,6 +104,13 @@ type Egress struct {
 
 	// Batching contains the settings we use to batch calls to our backend.
 	Batching Batching `json:"batching"`
+
+	// Spool configures storing batches that could not be sent on disk, so that they are sent again
+	// once the backend recovers.
+	Spool Spool `json:"spool"`
+
+	// RateLimit limits the rate of requests to the backend per organization.
+	RateLimit RateLimit `json:"rateLimit"`
 }
 
 type Batching struct {
@@ -80,6 +118,10 @@ type Batching struct {
 	Interval metav1.Duration `json:"interval"`
 	// Maximum size of a batch.
 	MaxSize int `json:"maxSize"`
+	// Maximum size of a request body in bytes. Batches that exceed it are split and sent in
+	// multiple requests. Zero means no limit, in which case batches are only split if the backend
+	// rejects them as too large.
+	MaxBytes int64 `json:"maxBytes"`
 }
 
 func defaultBatching() Batching {
@@ -89,15 +131,352 @@ func defaultBatching() Batching {
 	}
 }
 
+type Spool struct {
+	// Enabled turns on the spool.
+	Enabled bool `json:"enabled"`
+	// Directory is the directory the batches are stored in, which should be a volume that
+	// survives restarts of the scanner.
+	Directory string `json:"directory"`
+	// MaxBytes is the maximum total size of the spooled batches.
+	MaxBytes int64 `json:"maxBytes"`
+	// MaxAge is the age after which spooled batches are dropped. Zero keeps batches until they
+	// have been sent or are evicted.
+	MaxAge metav1.Duration `json:"maxAge"`
+	// EvictionPolicy defines which batches are dropped when the spool is full, either
+	// "dropOldest" or "rejectNewest".
+	EvictionPolicy string `json:"evictionPolicy"`
+	// ReplayInterval is the interval in which the spooled batches are sent again. After failures,
+	// the interval is doubled up to the MaxReplayInterval.
+	ReplayInterval metav1.Duration `json:"replayInterval"`
+	// MaxReplayInterval is the maximum interval between attempts to send spooled batches.
+	MaxReplayInterval metav1.Duration `json:"maxReplayInterval"`
+}
+
+func defaultSpool() Spool {
+	return Spool{
+		Directory:         "/var/spool/kubernetes-scanner",
+		MaxBytes:          100 << 20,
+		MaxAge:            metav1.Duration{Duration: 24 * time.Hour},
+		EvictionPolicy:    "dropOldest",
+		ReplayInterval:    metav1.Duration{Duration: 30 * time.Second},
+		MaxReplayInterval: metav1.Duration{Duration: 10 * time.Minute},
+	}
+}
+
+func (s Spool) validate() error {
+	if !s.Enabled {
+		return nil
+	}
+
+	if s.Directory == "" {
+		return fmt.Errorf("no spool directory set")
+	}
+
+	if s.MaxBytes <= 0 {
+		return fmt.Errorf("max bytes must be positive")
+	}
+
+	if s.MaxAge.Duration < 0 {
+		return fmt.Errorf("max age must not be negative")
+	}
+
+	if s.EvictionPolicy != "dropOldest" && s.EvictionPolicy != "rejectNewest" {
+		return fmt.Errorf("unknown eviction policy %q, must be one of [dropOldest rejectNewest]", s.EvictionPolicy)
+	}
+
+	if s.ReplayInterval.Duration <= 0 {
+		return fmt.Errorf("replay interval must be positive")
+	}
+
+	if s.MaxReplayInterval.Duration < s.ReplayInterval.Duration {
+		return fmt.Errorf("max replay interval (%v) must not be less than the replay interval (%v)",
+			s.MaxReplayInterval.Duration, s.ReplayInterval.Duration)
+	}
+
+	return nil
+}
+
+type RateLimit struct {
+	// RequestsPerSecond is the maximum rate of requests per organization. Whenever the backend
+	// throttles requests, the rate is halved, and recovers gradually afterwards. Zero does not
+	// limit the rate until the backend throttles requests, which lowers it to half the burst per
+	// second. Requests are paused if the backend asks to retry them later either way.
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// MinRequestsPerSecond is the rate that throttling never lowers the rate below.
+	MinRequestsPerSecond float64 `json:"minRequestsPerSecond"`
+	// Burst is the number of requests per organization that can be sent at once.
+	Burst int `json:"burst"`
+}
+
+func defaultRateLimit() RateLimit {
+	return RateLimit{
+		RequestsPerSecond:    0,
+		MinRequestsPerSecond: 0.1,
+		Burst:                10,
+	}
+}
+
+func (r RateLimit) validate() error {
+	switch {
+	case r.RequestsPerSecond < 0:
+		return fmt.Errorf("requests per second must not be negative")
+	case r.MinRequestsPerSecond <= 0:
+		return fmt.Errorf("min requests per second must be positive")
+	case r.RequestsPerSecond > 0 && r.RequestsPerSecond < r.MinRequestsPerSecond:
+		return fmt.Errorf("requests per second (%v) must not be less than the min requests per second (%v)",
+			r.RequestsPerSecond, r.MinRequestsPerSecond)
+	}
+
+	if r.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
+	}
+
+	return nil
+}
+
+type LeaderElection struct {
+	// Enabled turns on leader election. Required when running more than one replica.
+	Enabled bool `json:"enabled"`
+	// LeaseName is the name of the Lease object that the replicas compete for.
+	LeaseName string `json:"leaseName"`
+	// LeaseNamespace is the namespace of the Lease object. If unset, the namespace the scanner
+	// is running in is used.
+	LeaseNamespace string `json:"leaseNamespace"`
+	// LeaseDuration is the duration that standby replicas will wait before forcefully acquiring
+	// leadership, i.e. the maximum time it takes to fail over.
+	LeaseDuration metav1.Duration `json:"leaseDuration"`
+	// RenewDeadline is the duration that the leader will retry refreshing its leadership before
+	// giving it up.
+	RenewDeadline metav1.Duration `json:"renewDeadline"`
+	// RetryPeriod is the duration the replicas wait between attempts of acquiring or renewing
+	// leadership.
+	RetryPeriod metav1.Duration `json:"retryPeriod"`
+}
+
+func defaultLeaderElection() LeaderElection {
+	return LeaderElection{
+		LeaseName:     "kubernetes-scanner",
+		LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+		RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+		RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+	}
+}
+
+func (l LeaderElection) validate() error {
+	if !l.Enabled {
+		return nil
+	}
+
+	if l.LeaseName == "" {
+		return fmt.Errorf("no lease name set")
+	}
+
+	if l.RetryPeriod.Duration <= 0 {
+		return fmt.Errorf("retry period must be positive")
+	}
+
+	if l.RenewDeadline.Duration <= l.RetryPeriod.Duration {
+		return fmt.Errorf("renew deadline (%v) must be greater than the retry period (%v)",
+			l.RenewDeadline.Duration, l.RetryPeriod.Duration)
+	}
+
+	if l.LeaseDuration.Duration <= l.RenewDeadline.Duration {
+		return fmt.Errorf("lease duration (%v) must be greater than the renew deadline (%v)",
+			l.LeaseDuration.Duration, l.RenewDeadline.Duration)
+	}
+
+	return nil
+}
+
+type Sharding struct {
+	// Enabled turns on sharding. Each replica will only scan the namespaces assigned to it.
+	Enabled bool `json:"enabled"`
+	// GroupName identifies the replicas that share the work. It is used as a label and name prefix
+	// for the Lease objects of the replicas.
+	GroupName string `json:"groupName"`
+	// LeaseNamespace is the namespace that the Lease objects of the replicas are created in.
+	LeaseNamespace string `json:"leaseNamespace"`
+	// LeaseDuration is the duration after which a replica that stopped renewing its Lease is
+	// considered gone and its namespaces are reassigned to the remaining replicas.
+	LeaseDuration metav1.Duration `json:"leaseDuration"`
+	// RenewInterval is the interval in which each replica renews its Lease and checks for replicas
+	// that joined or left.
+	RenewInterval metav1.Duration `json:"renewInterval"`
+}
+
+func defaultSharding() Sharding {
+	return Sharding{
+		GroupName:     "kubernetes-scanner",
+		LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+		RenewInterval: metav1.Duration{Duration: 5 * time.Second},
+	}
+}
+
+func (s Sharding) validate() error {
+	if !s.Enabled {
+		return nil
+	}
+
+	if s.GroupName == "" {
+		return fmt.Errorf("no group name set")
+	}
+
+	if s.LeaseNamespace == "" {
+		return fmt.Errorf("no lease namespace set")
+	}
+
+	if s.RenewInterval.Duration <= 0 {
+		return fmt.Errorf("renew interval must be positive")
+	}
+
+	if s.LeaseDuration.Duration <= s.RenewInterval.Duration {
+		return fmt.Errorf("lease duration (%v) must be greater than the renew interval (%v)",
+			s.LeaseDuration.Duration, s.RenewInterval.Duration)
+	}
+
+	return nil
+}
+
+type NamespaceScope struct {
+	// Enabled restricts the scanner to the given namespaces. All informer caches are namespaced,
+	// and cluster-scoped resource types are skipped, as they would require cluster-wide
+	// permissions.
+	Enabled bool `json:"enabled"`
+	// Namespaces is the list of namespaces that the scanner operates in. Does not support the "*"
+	// wildcard or any other patterns.
+	Namespaces []string `json:"namespaces"`
+}
+
+func (n NamespaceScope) validate() error {
+	if !n.Enabled {
+		return nil
+	}
+
+	if len(n.Namespaces) == 0 {
+		return fmt.Errorf("no namespaces set")
+	}
+
+	for _, ns := range n.Namespaces {
+		// the namespaces need to be known upfront, so patterns are not supported.
+		if p, err := compileNamespacePattern(ns); err != nil || p.name == "" {
+			return fmt.Errorf("invalid namespace %q", ns)
+		}
+	}
+
+	return nil
+}
+
+type RoutingState struct {
+	// Enabled turns on persisting the routing state in a ConfigMap.
+	Enabled bool `json:"enabled"`
+	// ConfigMapName is the name of the ConfigMap that the routing state is stored in.
+	ConfigMapName string `json:"configMapName"`
+	// ConfigMapNamespace is the namespace of the ConfigMap.
+	ConfigMapNamespace string `json:"configMapNamespace"`
+	// SyncInterval defines how often changes to the routing state are written to the ConfigMap.
+	// Changes that have not been written when the scanner stops unexpectedly are lost.
+	SyncInterval metav1.Duration `json:"syncInterval"`
+}
+
+func defaultRoutingState() RoutingState {
+	return RoutingState{
+		ConfigMapName: "kubernetes-scanner-routing",
+		SyncInterval:  metav1.Duration{Duration: 30 * time.Second},
+	}
+}
+
+func (r RoutingState) validate() error {
+	if !r.Enabled {
+		return nil
+	}
+
+	if r.ConfigMapName == "" {
+		return fmt.Errorf("no config map name set")
+	}
+
+	if r.ConfigMapNamespace == "" {
+		return fmt.Errorf("no config map namespace set")
+	}
+
+	if r.SyncInterval.Duration <= 0 {
+		return fmt.Errorf("sync interval must be positive")
+	}
+
+	return nil
+}
+
 type Route struct {
 	// OrganizationID is the snyk organization ID where data should be routed to.
 	OrganizationID string `json:"organizationID"`
+	// OrganizationIDAnnotation routes resources to the organization ID that is set in this
+	// annotation on their namespace, instead of a fixed organization. Namespaces without the
+	// annotation are not routed by this route. Cannot be combined with organizationID.
+	OrganizationIDAnnotation string `json:"organizationIDAnnotation,omitempty"`
+	// AllowedOrganizationIDs optionally restricts the organizations that resources can be routed to
+	// through the organizationIDAnnotation.
+	AllowedOrganizationIDs []string `json:"allowedOrganizationIDs,omitempty"`
 	// ClusterScopedResources defines if cluster-scoped resources should be sent to the API.
 	ClusterScopedResources bool `json:"clusterScopedResources"`
 	// Namespaces from which resources will be sent to the API.
 	// If empty, namespaced resources will not be sent at all.
-	// Supports "*" to match all namespaces
+	// Supports "*" to match all namespaces, as well as glob and regex patterns as described by
+	// NamespaceMatcher.
 	Namespaces []string `json:"namespaces"`
+	// ExcludeNamespaces is a list of namespaces or patterns that are never routed by this route.
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	// NamespaceSelector additionally routes resources from all namespaces whose labels match the
+	// selector.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Types optionally restricts the routed resources to the given types. Omit to route resources
+	// of all scanned types.
+	Types []RouteType `json:"types,omitempty"`
+	// PathsToRemove are removed from resources before they are sent to the organization, in
+	// addition to the attributeRemovals of the scan type. Other organizations are not affected.
+	PathsToRemove []string `json:"attributeRemovals,omitempty"`
+}
+
+// RouteType is a set of resource types, in the same format as the groups and resources of a
+// ScanType.
+type RouteType struct {
+	// APIGroups of the resources. Use "*" for all groups.
+	APIGroups []string `json:"apiGroups"`
+	// Resources of the selected groups. Use "*" for all resources of the groups.
+	Resources []string `json:"resources"`
+	// ExcludeResources is a list of resource names that are excluded in any of the selected
+	// groups.
+	ExcludeResources []string `json:"excludeResources,omitempty"`
+}
+
+func (t RouteType) validate() error {
+	if len(t.APIGroups) == 0 || len(t.Resources) == 0 {
+		return fmt.Errorf("route types need both apiGroups and resources")
+	}
+	if slices.Contains(t.ExcludeResources, Wildcard) {
+		return fmt.Errorf("excludeResources must not contain %q", Wildcard)
+	}
+	return nil
+}
+
+// Matches returns true if the resource of the given group is part of the type.
+func (t RouteType) Matches(gr schema.GroupResource) bool {
+	if slices.Contains(t.ExcludeResources, gr.Resource) {
+		return false
+	}
+	return (slices.Contains(t.APIGroups, Wildcard) || slices.Contains(t.APIGroups, gr.Group)) &&
+		(slices.Contains(t.Resources, Wildcard) || slices.Contains(t.Resources, gr.Resource))
+}
+
+// MatchesType returns true if resources of the given group are routed by the route.
+func (r Route) MatchesType(gr schema.GroupResource) bool {
+	if len(r.Types) == 0 {
+		return true
+	}
+	for _, t := range r.Types {
+		if t.Matches(gr) {
+			return true
+		}
+	}
+	return false
 }
 
 type GroupVersionKind struct {
@@ -119,19 +498,78 @@ func (e Egress) validate() error {
 		return fmt.Errorf("no Snyk service account token set")
 	}
 
+	if e.Batching.MaxBytes < 0 {
+		return fmt.Errorf("max bytes of a batch must not be negative")
+	}
+
+	if err := e.Spool.validate(); err != nil {
+		return fmt.Errorf("could not validate spool settings: %w", err)
+	}
+
+	if err := e.RateLimit.validate(); err != nil {
+		return fmt.Errorf("could not validate rate limit settings: %w", err)
+	}
+
 	return nil
 }
 
 func (r Route) validate() error {
+	for _, t := range r.Types {
+		if err := t.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.OrganizationIDAnnotation != "" {
+		return r.validateAnnotationRoute()
+	}
+
 	if r.OrganizationID == "" {
 		return fmt.Errorf("organization ID is missing")
 	}
-	if len(r.Namespaces) == 0 && !r.ClusterScopedResources {
+	if len(r.AllowedOrganizationIDs) > 0 {
+		return fmt.Errorf("allowed organization IDs can only be set with an organization ID annotation")
+	}
+	if len(r.Namespaces) == 0 && r.NamespaceSelector == nil && !r.ClusterScopedResources {
 		return fmt.Errorf("no namespace or ClusterResource routing defined for the organization %s", r.OrganizationID)
 	}
+	if _, err := r.Selector(); err != nil {
+		return err
+	}
+	if _, err := r.NamespaceMatcher(); err != nil {
+		return fmt.Errorf("invalid namespaces for organization %s: %w", r.OrganizationID, err)
+	}
+	return nil
+}
+
+func (r Route) validateAnnotationRoute() error {
+	if r.OrganizationID != "" {
+		return fmt.Errorf("organization ID and organization ID annotation cannot be set at the same time")
+	}
+	if r.ClusterScopedResources || len(r.Namespaces) > 0 || r.NamespaceSelector != nil {
+		return fmt.Errorf("the route of the organization ID annotation %s routes namespaces by their annotation "+
+			"and cannot define any other routing", r.OrganizationIDAnnotation)
+	}
+	if _, err := r.NamespaceMatcher(); err != nil {
+		return fmt.Errorf("invalid namespaces for organization ID annotation %s: %w", r.OrganizationIDAnnotation, err)
+	}
 	return nil
 }
 
+// Selector returns the parsed namespace selector of the route. Returns nil if the route has no
+// namespace selector.
+func (r Route) Selector() (labels.Selector, error) {
+	if r.NamespaceSelector == nil {
+		return nil, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(r.NamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse namespace selector of organization %s: %w", r.OrganizationID, err)
+	}
+	return selector, nil
+}
+
 // default values for config settings
 const (
 	// HTTPClientDefaultTimeout is the default value for the HTTPClientTimeout setting.
@@ -147,8 +585,26 @@ type Scan struct {
 	// Note that due to the event handlers, objects that are being changed will be requeued earlier
 	// in such cases.
 	RequeueAfter metav1.Duration `json:"requeueAfter"`
+	// DiscoveryInterval defines how often the scanner checks for resource types that have been
+	// installed (e.g. through CRDs) or removed since it started. Setting it to zero disables
+	// re-running the discovery.
+	DiscoveryInterval metav1.Duration `json:"discoveryInterval"`
+	// ResendUnchangedAfter enables skipping resources that did not change since they have last
+	// been sent successfully. Unchanged resources are still sent once this duration has passed, so
+	// that the backend knows they still exist. Setting it to zero always sends all resources.
+	ResendUnchangedAfter metav1.Duration `json:"resendUnchangedAfter"`
+	// DeletionDetectionInterval enables detecting resources that have been deleted while the
+	// scanner was not running. On startup and then in this interval, the resources known to Snyk
+	// are compared with the ones in the cluster, and deletions are sent for the ones that don't
+	// exist anymore. Setting it to zero disables the detection.
+	DeletionDetectionInterval metav1.Duration `json:"deletionDetectionInterval"`
 }
 
+const (
+	DefaultDiscoveryInterval = 5 * time.Minute
+	DefaultReloadInterval    = 30 * time.Second
+)
+
 // Read reads the config file from the specificied flag "-config" and returns a
 // struct that contains all options, including other flags.
 func Read(configFile string) (*Config, error) {
@@ -167,7 +623,18 @@ func Read(configFile string) (*Config, error) {
 			SnykAPIBaseURL:          SnykAPIDefaultBaseURL,
 			SnykServiceAccountToken: os.Getenv("SNYK_SERVICE_ACCOUNT_TOKEN"),
 			Batching:                defaultBatching(),
+			Spool:                   defaultSpool(),
+			RateLimit:               defaultRateLimit(),
 		},
+		Scanning: Scan{
+			DiscoveryInterval: metav1.Duration{Duration: DefaultDiscoveryInterval},
+		},
+		LeaderElection: defaultLeaderElection(),
+		Sharding:       defaultSharding(),
+		RoutingState:   defaultRoutingState(),
+		ReloadInterval: metav1.Duration{Duration: DefaultReloadInterval},
+		path:           configFile,
+		checksum:       sha256.Sum256(b),
 	}
 
 	if c.RestConfig, err = ctrl.GetConfig(); err != nil {
@@ -188,6 +655,28 @@ func Read(configFile string) (*Config, error) {
 		}
 	}
 
+	for _, scanType := range c.Scanning.Types {
+		if err := scanType.validate(); err != nil {
+			return nil, fmt.Errorf("could not validate scan types in config file: %w", err)
+		}
+	}
+
+	if c.Scanning.DiscoveryInterval.Duration < 0 {
+		return nil, fmt.Errorf("discoveryInterval must not be negative")
+	}
+
+	if c.Scanning.ResendUnchangedAfter.Duration < 0 {
+		return nil, fmt.Errorf("resendUnchangedAfter must not be negative")
+	}
+
+	if c.Scanning.DeletionDetectionInterval.Duration < 0 {
+		return nil, fmt.Errorf("deletionDetectionInterval must not be negative")
+	}
+
+	if c.ReloadInterval.Duration < 0 {
+		return nil, fmt.Errorf("reloadInterval must not be negative")
+	}
+
 	if err := c.Egress.validate(); err != nil {
 		return nil, fmt.Errorf("could not validate egress settings: %w", err)
 	}
@@ -196,28 +685,94 @@ func Read(configFile string) (*Config, error) {
 		return nil, fmt.Errorf("could not validate logging settings: %w", err)
 	}
 
+	if err := c.LeaderElection.validate(); err != nil {
+		return nil, fmt.Errorf("could not validate leader election settings: %w", err)
+	}
+
+	if err := c.Sharding.validate(); err != nil {
+		return nil, fmt.Errorf("could not validate sharding settings: %w", err)
+	}
+
+	if c.Sharding.Enabled && c.LeaderElection.Enabled {
+		return nil, fmt.Errorf("sharding and leader election cannot be enabled at the same time")
+	}
+
+	if err := c.NamespaceScope.validate(); err != nil {
+		return nil, fmt.Errorf("could not validate namespace scope settings: %w", err)
+	}
+
+	if err := c.RoutingState.validate(); err != nil {
+		return nil, fmt.Errorf("could not validate routing state settings: %w", err)
+	}
+
+	// every replica only knows the resources of its own shard.
+	if c.RoutingState.Enabled && c.Sharding.Enabled {
+		return nil, fmt.Errorf("routing state and sharding cannot be enabled at the same time")
+	}
+
 	return c, nil
 }
 
+// Path returns the file the config has been read from. It is empty if the config has not been
+// read from a file.
+func (c *Config) Path() string {
+	return c.path
+}
+
+// Checksum returns the checksum of the file contents the config has been read from.
+func (c *Config) Checksum() [sha256.Size]byte {
+	return c.checksum
+}
+
+// FileChecksum returns the checksum of the given config file, to detect changes to it.
+func FileChecksum(configFile string) ([sha256.Size]byte, error) {
+	b, err := os.ReadFile(configFile)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("could not read config file: %w", err)
+	}
+	return sha256.Sum256(b), nil
+}
+
 type Discovery interface {
+	// groups should return the names of all groups that are served by the API server.
+	groups() []string
 	// versionsForGroup should return all versions for a given group, where the first version should
 	// be the preferredVersion.
 	versionsForGroup(string) ([]string, error)
-	findGVK(schema.GroupVersionResource) (schema.GroupVersionKind, error)
+	// resourcesForGroupVersion should return all resources that are served in the given
+	// groupversion.
+	resourcesForGroupVersion(schema.GroupVersion) ([]metav1.APIResource, error)
 	findGroupPreferredVersion(group string) (string, error)
 }
 
+// Wildcard can be used in apiGroups, resources and versions to select all values that are served
+// by the API server.
+const Wildcard = "*"
+
 type ScanType struct {
-	// TODO: The "*" group / resource specifier isn't implemented yet (and maybe never will).
+	// APIGroups to scan. Use "*" to scan all groups that are served by the API server.
 	APIGroups []string `json:"apiGroups"`
+	// Resources to scan. Use "*" to scan all resources of the selected groups.
 	Resources []string `json:"resources"`
+	// ExcludeResources is a list of resource names that should not be scanned, in any of the
+	// selected groups. This is mostly useful in combination with the "*" resource specifier.
+	ExcludeResources []string `json:"excludeResources,omitempty"`
 	// Versions is an optional field to specify which exact versions should be scanned. If unset,
 	// the scanner will use the API Server's preferred version.
 	Versions []string `json:"versions"`
 	// Namespaces allows to restrict scanning to specific namespaces. An empty list means no
 	// namespaces. Omit to scan resources in all namespaces. Does not affect the scanning of
-	// cluster-scoped resources.
+	// cluster-scoped resources. Supports glob and regex patterns as described by NamespaceMatcher.
 	Namespaces []string `json:"namespaces,omitempty"`
+	// ExcludeNamespaces is a list of namespaces or patterns that are not scanned.
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	// LabelSelector restricts scanning to objects with matching labels, in the format used by
+	// kubectl, e.g. "team in (payments, ledger)". Omit to scan objects regardless of their labels.
+	LabelSelector string `json:"labelSelector,omitempty"`
+	// FieldSelector restricts scanning to objects with matching fields, in the format used by
+	// kubectl, e.g. "metadata.namespace!=kube-system". Only the fields in selectableFields can be
+	// used, as the API server only supports a few other fields for some resource types.
+	FieldSelector string `json:"fieldSelector,omitempty"`
 
 	// These are dot-separated address for nested values, in the same format as
 	// arguments to `kubectl explain`.
@@ -225,66 +780,257 @@ type ScanType struct {
 	// container environment variables to be removed. "containers" is an array,
 	// and each element of this array is removed.
 	PathsToRemove []string `json:"attributeRemovals"`
+
+	// UpdatePredicates restrict which updates of an object trigger a new scan. An update is scanned
+	// if it matches any of the predicates. If unset, all updates are scanned. Objects are still
+	// scanned periodically as defined by requeueAfter.
+	UpdatePredicates []UpdatePredicate `json:"updatePredicates,omitempty"`
+
+	// MetadataOnly reduces the memory usage of the scanner by only caching the metadata of objects.
+	// Objects are fetched from the API server whenever they are scanned, which happens anyway.
+	// The ignoreStatus update predicate can't be used for metadata-only scan types.
+	MetadataOnly bool `json:"metadataOnly,omitempty"`
+}
+
+type UpdatePredicate string
+
+const (
+	// UpdatePredicateGenerationChanged matches updates that changed the metadata.generation of an
+	// object. Note that not all types (e.g. ConfigMaps) make use of the generation.
+	UpdatePredicateGenerationChanged UpdatePredicate = "generationChanged"
+	// UpdatePredicateLabelsChanged matches updates that changed the labels of an object.
+	UpdatePredicateLabelsChanged UpdatePredicate = "labelsChanged"
+	// UpdatePredicateAnnotationsChanged matches updates that changed the annotations of an object.
+	UpdatePredicateAnnotationsChanged UpdatePredicate = "annotationsChanged"
+	// UpdatePredicateIgnoreStatus matches all updates that changed anything but the status of an
+	// object.
+	UpdatePredicateIgnoreStatus UpdatePredicate = "ignoreStatus"
+)
+
+var updatePredicates = []UpdatePredicate{
+	UpdatePredicateGenerationChanged,
+	UpdatePredicateLabelsChanged,
+	UpdatePredicateAnnotationsChanged,
+	UpdatePredicateIgnoreStatus,
+}
+
+func (st ScanType) validate() error {
+	if slices.Contains(st.ExcludeResources, Wildcard) {
+		return fmt.Errorf("excludeResources must not contain %q", Wildcard)
+	}
+
+	for _, p := range st.UpdatePredicates {
+		if !slices.Contains(updatePredicates, p) {
+			return fmt.Errorf("unknown update predicate %q, must be one of %v", p, updatePredicates)
+		}
+	}
+
+	if st.MetadataOnly && slices.Contains(st.UpdatePredicates, UpdatePredicateIgnoreStatus) {
+		return fmt.Errorf("the %q update predicate can't be used for metadata-only scan types", UpdatePredicateIgnoreStatus)
+	}
+
+	if _, _, err := st.Selectors(); err != nil {
+		return err
+	}
+
+	if _, err := st.NamespaceMatcher(); err != nil {
+		return fmt.Errorf("invalid namespaces: %w", err)
+	}
+	return nil
+}
+
+// selectableFields are the fields that the API server supports in field selectors of all resource
+// types.
+var selectableFields = []string{"metadata.name", "metadata.namespace"}
+
+// Selectors returns the parsed label and field selectors of the scan type. Unset selectors select
+// everything.
+func (st ScanType) Selectors() (labels.Selector, fields.Selector, error) {
+	labelSelector, err := labels.Parse(st.LabelSelector)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse label selector %q: %w", st.LabelSelector, err)
+	}
+
+	fieldSelector, err := fields.ParseSelector(st.FieldSelector)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse field selector %q: %w", st.FieldSelector, err)
+	}
+	for _, req := range fieldSelector.Requirements() {
+		if !slices.Contains(selectableFields, req.Field) {
+			return nil, nil, fmt.Errorf("field selector %q can't select field %q, must be one of %v",
+				st.FieldSelector, req.Field, selectableFields)
+		}
+	}
+
+	return labelSelector, fieldSelector, nil
 }
 
 // GetGVKs returns all the GVKs that are defined in the ScanType and are available on the server.
+// Resources that do not support the list and watch verbs are skipped, as they can't be scanned.
+// Groups that are selected through the "*" wildcard are skipped if their discovery fails, as
+// e.g. an unavailable aggregated API should not prevent scanning all other groups.
 func (st ScanType) GetGVKs(d Discovery, log logr.Logger) ([]GroupVersionKind, error) {
+	groups := st.APIGroups
+	wildcard := slices.Contains(groups, Wildcard)
+	if wildcard {
+		groups = d.groups()
+	}
+
 	var gvks []GroupVersionKind
-	for _, group := range st.APIGroups {
-		versions := st.Versions
-		if slices.Contains(versions, "*") || len(versions) == 0 {
-			var err error
-			versions, err = d.versionsForGroup(group)
+	failed := &k8sdiscovery.ErrGroupDiscoveryFailed{Groups: make(map[schema.GroupVersion]error)}
+	for _, group := range groups {
+		groupGVKs, err := st.groupGVKs(d, group, log)
+		if err != nil {
+			if !wildcard {
+				return nil, err
+			}
+			failed.Groups[schema.GroupVersion{Group: group}] = err
+			continue
+		}
+		gvks = append(gvks, groupGVKs...)
+	}
+
+	if len(failed.Groups) > 0 {
+		log.Error(failed, "skipping groups whose discovery failed")
+	}
+	return gvks, nil
+}
+
+// groupGVKs returns the GVKs that are defined in the ScanType for the given group.
+func (st ScanType) groupGVKs(d Discovery, group string, log logr.Logger) ([]GroupVersionKind, error) {
+	versions := st.Versions
+	if slices.Contains(versions, Wildcard) || len(versions) == 0 {
+		var err error
+		versions, err = d.versionsForGroup(group)
+		if err != nil {
+			if !k8serrors.IsNotFound(err) {
+				return nil, fmt.Errorf("could not get versions for group %v: %w", group, err)
+			}
+
+			log.Info("skipping group as it does not exist", "group", group)
+			return nil, nil
+		}
+	}
+
+	// Only find preferred version after ensuring that the group exists
+	preferredVersion, err := d.findGroupPreferredVersion(group)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := st.Resources
+	if slices.Contains(resources, Wildcard) {
+		if resources, err = allResources(d, group, versions); err != nil {
+			return nil, err
+		}
+	}
+
+	var gvks []GroupVersionKind
+nextResource:
+	for _, resource := range resources {
+		if slices.Contains(st.ExcludeResources, resource) {
+			continue
+		}
+
+		for _, version := range versions {
+			gvr := schema.GroupVersionResource{
+				Group:    group,
+				Version:  version,
+				Resource: resource,
+			}
+			res, err := findResource(d, gvr)
 			if err != nil {
 				if !k8serrors.IsNotFound(err) {
-					return nil, fmt.Errorf("could not get versions for group %v: %w", group, err)
+					return nil, fmt.Errorf("could not get GVK for GVR %v: %w", gvr, err)
 				}
 
-				log.Info("skipping group as it does not exist", "group", group)
+				log.Info("skipping GVR as resource does not exist within groupversion",
+					"group", group, "resource", resource, "version", version)
+				// try finding this resource type in another version of this group.
 				continue
 			}
+
+			if !isWatchable(res) {
+				log.Info("skipping GVR as resource does not support list and watch",
+					"group", group, "resource", resource, "version", version)
+				continue nextResource
+			}
+
+			gvk := gvr.GroupVersion().WithKind(res.Kind)
+			gvks = append(gvks, GroupVersionKind{GroupVersionKind: gvk, PreferredVersion: preferredVersion})
+
+			// if no versions where initially specified, we're looking for a single
+			// GroupVersionResource combination. Usually, the version in that should be the
+			// APIServer's preferredVersion. However, as the preferredVersion might not always
+			// contain all specified resource types, we can only continue with the nextResource
+			// once we've found the resource in a version.
+			if len(st.Versions) == 0 {
+				continue nextResource
+			}
 		}
+	}
 
-		// Only find preferred version after ensuring that the group exists
-		preferredVersion, err := d.findGroupPreferredVersion(group)
+	return gvks, nil
+}
+
+// allResources returns the names of all resources that are served in any of the given versions of
+// the group. Subresources are not included.
+func allResources(d Discovery, group string, versions []string) ([]string, error) {
+	var resources []string
+	for _, version := range versions {
+		gv := schema.GroupVersion{Group: group, Version: version}
+		list, err := d.resourcesForGroupVersion(gv)
 		if err != nil {
-			return nil, err
+			if k8serrors.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("could not get resources for groupversion %v: %w", gv, err)
 		}
 
-	nextResource:
-		for _, resource := range st.Resources {
-			for _, version := range versions {
-				gvr := schema.GroupVersionResource{
-					Group:    group,
-					Version:  version,
-					Resource: resource,
-				}
-				gvk, err := d.findGVK(gvr)
-				if err != nil {
-					if !k8serrors.IsNotFound(err) {
-						return nil, fmt.Errorf("could not get GVK for GVR %v: %w", gvr, err)
-					}
-
-					log.Info("skipping GVR as resource does not exist within groupversion",
-						"group", group, "resource", resource, "version", version)
-					// try finding this resource type in another version of this group.
-					continue
-				}
-				gvks = append(gvks, GroupVersionKind{GroupVersionKind: gvk, PreferredVersion: preferredVersion})
-
-				// if no versions where initially specified, we're looking for a single
-				// GroupVersionResource combination. Usually, the version in that should be the
-				// APIServer's preferredVersion. However, as the preferredVersion might not always
-				// contain all specified resource types, we can only continue with the nextResource
-				// once we've found the resource in a version.
-				if len(st.Versions) == 0 {
-					continue nextResource
-				}
+		for _, res := range list {
+			if strings.Contains(res.Name, "/") || slices.Contains(resources, res.Name) {
+				continue
 			}
+			resources = append(resources, res.Name)
 		}
 	}
+	return resources, nil
+}
+
+// findResource returns the APIResource for the given GVR.
+func findResource(d Discovery, gvr schema.GroupVersionResource) (metav1.APIResource, error) {
+	resources, err := d.resourcesForGroupVersion(gvr.GroupVersion())
+	if err != nil {
+		return metav1.APIResource{}, err
+	}
 
-	return gvks, nil
+	for _, res := range resources {
+		if res.Name == gvr.Resource {
+			return res, nil
+		}
+	}
+
+	return metav1.APIResource{}, newNotFoundError(gvr)
+}
+
+// IsNamespaced returns true if the given GVK is a namespaced resource type.
+func IsNamespaced(d Discovery, gvk schema.GroupVersionKind) (bool, error) {
+	resources, err := d.resourcesForGroupVersion(gvk.GroupVersion())
+	if err != nil {
+		return false, err
+	}
+
+	for _, res := range resources {
+		if res.Kind == gvk.Kind && !strings.Contains(res.Name, "/") {
+			return res.Namespaced, nil
+		}
+	}
+
+	return false, newNotFoundError(gvk.GroupVersion().WithResource(gvk.Kind))
+}
+
+func isWatchable(res metav1.APIResource) bool {
+	return slices.Contains(res.Verbs, "list") && slices.Contains(res.Verbs, "watch")
 }
 
 func (c *Config) Discovery() (Discovery, error) {
@@ -305,8 +1051,8 @@ func (c *Config) Discovery() (Discovery, error) {
 type discoveryHelper struct {
 	k8sdiscovery.DiscoveryInterface
 	// to cache all group versions that we retrieve.
-	resourcesForGroupVersion map[schema.GroupVersion][]metav1.APIResource
-	groups                   []metav1.APIGroup
+	resources    map[schema.GroupVersion][]metav1.APIResource
+	serverGroups []metav1.APIGroup
 }
 
 func newDiscoveryHelper(discoveryClient k8sdiscovery.DiscoveryInterface) (*discoveryHelper, error) {
@@ -316,14 +1062,14 @@ func newDiscoveryHelper(discoveryClient k8sdiscovery.DiscoveryInterface) (*disco
 	}
 
 	return &discoveryHelper{
-		DiscoveryInterface:       discoveryClient,
-		resourcesForGroupVersion: make(map[schema.GroupVersion][]metav1.APIResource),
-		groups:                   groups.Groups,
+		DiscoveryInterface: discoveryClient,
+		resources:          make(map[schema.GroupVersion][]metav1.APIResource),
+		serverGroups:       groups.Groups,
 	}, nil
 }
 
 func (d *discoveryHelper) versionsForGroup(apiGroup string) ([]string, error) {
-	for _, group := range d.groups {
+	for _, group := range d.serverGroups {
 		if group.Name == apiGroup {
 			// we always want to build a slice with the preferredVersion *first*.
 			var versions = []string{group.PreferredVersion.Version}
@@ -339,7 +1085,7 @@ func (d *discoveryHelper) versionsForGroup(apiGroup string) ([]string, error) {
 }
 
 func (d *discoveryHelper) findGroupPreferredVersion(group string) (string, error) {
-	for _, knownGroup := range d.groups {
+	for _, knownGroup := range d.serverGroups {
 		if group == knownGroup.Name {
 			preferredVersion := knownGroup.PreferredVersion.Version
 			if group == "" {
@@ -351,34 +1097,27 @@ func (d *discoveryHelper) findGroupPreferredVersion(group string) (string, error
 	return "", fmt.Errorf("no known preferred version for group %s", group)
 }
 
-// findGVK returns the GroupVersionKind for the given GVR.
-func (d *discoveryHelper) findGVK(gvr schema.GroupVersionResource) (schema.GroupVersionKind, error) {
-	gv := gvr.GroupVersion()
-
-	resources, ok := d.resourcesForGroupVersion[gv]
-	if !ok {
-		list, err := d.ServerResourcesForGroupVersion(gv.String())
-		if err != nil {
-			return schema.GroupVersionKind{}, fmt.Errorf(
-				"could not get server resources for groupversion %v: %w", gv, err,
-			)
-		}
+func (d *discoveryHelper) groups() []string {
+	groups := make([]string, 0, len(d.serverGroups))
+	for _, group := range d.serverGroups {
+		groups = append(groups, group.Name)
+	}
+	return groups
+}
 
-		d.resourcesForGroupVersion[gv] = list.APIResources
-		resources = list.APIResources
+// resourcesForGroupVersion returns all resources of the given groupversion. Results are cached.
+func (d *discoveryHelper) resourcesForGroupVersion(gv schema.GroupVersion) ([]metav1.APIResource, error) {
+	if resources, ok := d.resources[gv]; ok {
+		return resources, nil
 	}
 
-	for _, res := range resources {
-		if res.Name == gvr.Resource {
-			return schema.GroupVersionKind{
-				Group:   gv.Group,
-				Version: gv.Version,
-				Kind:    res.Kind,
-			}, nil
-		}
+	list, err := d.ServerResourcesForGroupVersion(gv.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not get server resources for groupversion %v: %w", gv, err)
 	}
 
-	return schema.GroupVersionKind{}, newNotFoundError(gvr)
+	d.resources[gv] = list.APIResources
+	return list.APIResources, nil
 }
 
 func newNotFoundError(gvr schema.GroupVersionResource) error {
@@ -386,14 +1125,23 @@ func newNotFoundError(gvr schema.GroupVersionResource) error {
 }
 
 // Organizations retrieves a list of unique Snyk Organization IDs present in
-// this configuration.
+// this configuration. Organizations that are routed to through an annotation
+// are only known if they are part of the route's allowlist.
 func (c *Config) Organizations() []string {
 	orgs := []string{}
 	seen := map[string]struct{}{}
 	for _, route := range c.Routes {
-		if _, ok := seen[route.OrganizationID]; !ok {
-			orgs = append(orgs, route.OrganizationID)
-			seen[route.OrganizationID] = struct{}{}
+		// organizations of annotation routes are only known if they are restricted.
+		routeOrgs := route.AllowedOrganizationIDs
+		if route.OrganizationIDAnnotation == "" {
+			routeOrgs = []string{route.OrganizationID}
+		}
+
+		for _, orgID := range routeOrgs {
+			if _, ok := seen[orgID]; !ok {
+				orgs = append(orgs, orgID)
+				seen[orgID] = struct{}{}
+			}
 		}
 	}
 	return orgs
@@ -17,8 +17,12 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
@@ -74,6 +78,89 @@ func TestRouteValidation(t *testing.T) {
 				Namespaces:             nil,
 			},
 		},
+		{
+			name:          "route with only a namespace selector should be valid",
+			errorExpected: false,
+			route: Route{
+				OrganizationID:    "umbrella",
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"snyk-org": "payments"}},
+			},
+		},
+		{
+			name:          "route with an organization ID annotation should be valid",
+			errorExpected: false,
+			route: Route{
+				OrganizationIDAnnotation: "snyk.io/org-id",
+				AllowedOrganizationIDs:   []string{"umbrella", "payments"},
+			},
+		},
+		{
+			name:          "route with an organization ID and annotation should fail",
+			errorExpected: true,
+			route: Route{
+				OrganizationID:           "umbrella",
+				OrganizationIDAnnotation: "snyk.io/org-id",
+			},
+		},
+		{
+			name:          "route with an organization ID annotation and namespaces should fail",
+			errorExpected: true,
+			route: Route{
+				OrganizationIDAnnotation: "snyk.io/org-id",
+				Namespaces:               []string{"*"},
+			},
+		},
+		{
+			name:          "route with allowed organization IDs but no annotation should fail",
+			errorExpected: true,
+			route: Route{
+				OrganizationID:         "umbrella",
+				Namespaces:             []string{"*"},
+				AllowedOrganizationIDs: []string{"umbrella"},
+			},
+		},
+		{
+			name:          "route with an invalid namespace selector should fail",
+			errorExpected: true,
+			route: Route{
+				OrganizationID: "umbrella",
+				NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "snyk-org", Operator: "Matches", Values: []string{"payments"}},
+				}},
+			},
+		},
+		{
+			name:          "route with types and attribute removals should be valid",
+			errorExpected: false,
+			route: Route{
+				OrganizationID: "umbrella",
+				Namespaces:     []string{"*"},
+				Types: []RouteType{
+					{APIGroups: []string{"*"}, Resources: []string{"*"}, ExcludeResources: []string{"configmaps"}},
+				},
+				PathsToRemove: []string{"spec.containers.env"},
+			},
+		},
+		{
+			name:          "route type without resources should fail",
+			errorExpected: true,
+			route: Route{
+				OrganizationID: "umbrella",
+				Namespaces:     []string{"*"},
+				Types:          []RouteType{{APIGroups: []string{"apps"}}},
+			},
+		},
+		{
+			name:          "route type excluding all resources should fail",
+			errorExpected: true,
+			route: Route{
+				OrganizationID: "umbrella",
+				Namespaces:     []string{"*"},
+				Types: []RouteType{
+					{APIGroups: []string{"*"}, Resources: []string{"*"}, ExcludeResources: []string{"*"}},
+				},
+			},
+		},
 	} {
 		t.Run(tc.name, func(tt *testing.T) {
 			err := tc.route.validate()
@@ -86,6 +173,403 @@ func TestRouteValidation(t *testing.T) {
 	}
 }
 
+func TestRouteMatchesType(t *testing.T) {
+	route := Route{Types: []RouteType{
+		{APIGroups: []string{""}, Resources: []string{"*"}, ExcludeResources: []string{"configmaps"}},
+		{APIGroups: []string{"apps"}, Resources: []string{"deployments"}},
+	}}
+
+	require.True(t, route.MatchesType(schema.GroupResource{Resource: "pods"}))
+	require.False(t, route.MatchesType(schema.GroupResource{Resource: "configmaps"}))
+	require.True(t, route.MatchesType(schema.GroupResource{Group: "apps", Resource: "deployments"}))
+	require.False(t, route.MatchesType(schema.GroupResource{Group: "apps", Resource: "statefulsets"}))
+	require.True(t, Route{}.MatchesType(schema.GroupResource{Resource: "configmaps"}),
+		"routes without types should route all types")
+}
+
+func TestLeaderElectionValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		errorExpected  bool
+		leaderElection func(*LeaderElection)
+	}{
+		{
+			name:           "disabled leader election is always valid",
+			errorExpected:  false,
+			leaderElection: func(l *LeaderElection) { l.Enabled = false; l.LeaseName = "" },
+		},
+		{
+			name:           "defaults should be valid",
+			errorExpected:  false,
+			leaderElection: func(l *LeaderElection) {},
+		},
+		{
+			name:           "missing lease name should fail",
+			errorExpected:  true,
+			leaderElection: func(l *LeaderElection) { l.LeaseName = "" },
+		},
+		{
+			name:          "renew deadline greater than lease duration should fail",
+			errorExpected: true,
+			leaderElection: func(l *LeaderElection) {
+				l.RenewDeadline = metav1.Duration{Duration: time.Minute}
+			},
+		},
+		{
+			name:          "zero retry period should fail",
+			errorExpected: true,
+			leaderElection: func(l *LeaderElection) {
+				l.RetryPeriod = metav1.Duration{}
+			},
+		},
+	} {
+		t.Run(tc.name, func(tt *testing.T) {
+			le := defaultLeaderElection()
+			le.Enabled = true
+			tc.leaderElection(&le)
+
+			err := le.validate()
+			if tc.errorExpected {
+				require.Error(tt, err)
+			} else {
+				require.NoError(tt, err)
+			}
+		})
+	}
+}
+
+func TestShardingValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		errorExpected bool
+		sharding      func(*Sharding)
+	}{
+		{
+			name:          "defaults with a lease namespace should be valid",
+			errorExpected: false,
+			sharding:      func(s *Sharding) {},
+		},
+		{
+			name:          "missing lease namespace should fail",
+			errorExpected: true,
+			sharding:      func(s *Sharding) { s.LeaseNamespace = "" },
+		},
+		{
+			name:          "renew interval greater than lease duration should fail",
+			errorExpected: true,
+			sharding: func(s *Sharding) {
+				s.RenewInterval = metav1.Duration{Duration: time.Minute}
+			},
+		},
+	} {
+		t.Run(tc.name, func(tt *testing.T) {
+			s := defaultSharding()
+			s.Enabled = true
+			s.LeaseNamespace = "kubernetes-scanner"
+			tc.sharding(&s)
+
+			err := s.validate()
+			if tc.errorExpected {
+				require.Error(tt, err)
+			} else {
+				require.NoError(tt, err)
+			}
+		})
+	}
+}
+
+func TestRateLimitValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		errorExpected bool
+		rateLimit     func(*RateLimit)
+	}{
+		{
+			name:          "defaults should be valid",
+			errorExpected: false,
+			rateLimit:     func(r *RateLimit) {},
+		},
+		{
+			name:          "limited rate should be valid",
+			errorExpected: false,
+			rateLimit:     func(r *RateLimit) { r.RequestsPerSecond = 10 },
+		},
+		{
+			name:          "negative requests per second should fail",
+			errorExpected: true,
+			rateLimit:     func(r *RateLimit) { r.RequestsPerSecond = -1 },
+		},
+		{
+			name:          "zero min requests per second should fail",
+			errorExpected: true,
+			rateLimit:     func(r *RateLimit) { r.RequestsPerSecond, r.MinRequestsPerSecond = 10, 0 },
+		},
+		{
+			name:          "zero min requests per second should fail with an unlimited rate",
+			errorExpected: true,
+			rateLimit:     func(r *RateLimit) { r.MinRequestsPerSecond = 0 },
+		},
+		{
+			name:          "requests per second less than the min should fail",
+			errorExpected: true,
+			rateLimit:     func(r *RateLimit) { r.RequestsPerSecond = 0.05 },
+		},
+		{
+			name:          "zero burst should fail",
+			errorExpected: true,
+			rateLimit:     func(r *RateLimit) { r.RequestsPerSecond, r.Burst = 10, 0 },
+		},
+		{
+			name:          "zero burst should fail with an unlimited rate",
+			errorExpected: true,
+			rateLimit:     func(r *RateLimit) { r.Burst = 0 },
+		},
+	} {
+		t.Run(tc.name, func(tt *testing.T) {
+			r := defaultRateLimit()
+			tc.rateLimit(&r)
+
+			err := r.validate()
+			if tc.errorExpected {
+				require.Error(tt, err)
+			} else {
+				require.NoError(tt, err)
+			}
+		})
+	}
+}
+
+func TestSpoolValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		errorExpected bool
+		spool         func(*Spool)
+	}{
+		{
+			name:          "defaults should be valid",
+			errorExpected: false,
+			spool:         func(s *Spool) {},
+		},
+		{
+			name:          "missing directory should fail",
+			errorExpected: true,
+			spool:         func(s *Spool) { s.Directory = "" },
+		},
+		{
+			name:          "zero max bytes should fail",
+			errorExpected: true,
+			spool:         func(s *Spool) { s.MaxBytes = 0 },
+		},
+		{
+			name:          "unknown eviction policy should fail",
+			errorExpected: true,
+			spool:         func(s *Spool) { s.EvictionPolicy = "dropRandom" },
+		},
+		{
+			name:          "max replay interval less than the replay interval should fail",
+			errorExpected: true,
+			spool: func(s *Spool) {
+				s.MaxReplayInterval = metav1.Duration{Duration: time.Second}
+			},
+		},
+	} {
+		t.Run(tc.name, func(tt *testing.T) {
+			s := defaultSpool()
+			s.Enabled = true
+			tc.spool(&s)
+
+			err := s.validate()
+			if tc.errorExpected {
+				require.Error(tt, err)
+			} else {
+				require.NoError(tt, err)
+			}
+		})
+	}
+}
+
+func TestRoutingStateValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		errorExpected bool
+		routingState  func(*RoutingState)
+	}{
+		{
+			name:          "defaults with a config map namespace should be valid",
+			errorExpected: false,
+			routingState:  func(r *RoutingState) {},
+		},
+		{
+			name:          "missing config map name should fail",
+			errorExpected: true,
+			routingState:  func(r *RoutingState) { r.ConfigMapName = "" },
+		},
+		{
+			name:          "missing config map namespace should fail",
+			errorExpected: true,
+			routingState:  func(r *RoutingState) { r.ConfigMapNamespace = "" },
+		},
+		{
+			name:          "zero sync interval should fail",
+			errorExpected: true,
+			routingState:  func(r *RoutingState) { r.SyncInterval = metav1.Duration{} },
+		},
+	} {
+		t.Run(tc.name, func(tt *testing.T) {
+			r := defaultRoutingState()
+			r.Enabled = true
+			r.ConfigMapNamespace = "kubernetes-scanner"
+			tc.routingState(&r)
+
+			err := r.validate()
+			if tc.errorExpected {
+				require.Error(tt, err)
+			} else {
+				require.NoError(tt, err)
+			}
+		})
+	}
+}
+
+func TestNamespaceScopeValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		errorExpected bool
+		scope         NamespaceScope
+	}{
+		{
+			name:          "disabled should be valid",
+			errorExpected: false,
+			scope:         NamespaceScope{},
+		},
+		{
+			name:          "namespaces should be valid",
+			errorExpected: false,
+			scope:         NamespaceScope{Enabled: true, Namespaces: []string{"team-a", "team-b"}},
+		},
+		{
+			name:          "missing namespaces should fail",
+			errorExpected: true,
+			scope:         NamespaceScope{Enabled: true},
+		},
+		{
+			name:          "wildcard should fail",
+			errorExpected: true,
+			scope:         NamespaceScope{Enabled: true, Namespaces: []string{"team-a", "*"}},
+		},
+	} {
+		t.Run(tc.name, func(tt *testing.T) {
+			err := tc.scope.validate()
+			if tc.errorExpected {
+				require.Error(tt, err)
+			} else {
+				require.NoError(tt, err)
+			}
+		})
+	}
+}
+
+func TestScanTypeValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		errorExpected bool
+		scanType      ScanType
+	}{
+		{
+			name:          "wildcard resources with excludes should be valid",
+			errorExpected: false,
+			scanType: ScanType{
+				APIGroups:        []string{"*"},
+				Resources:        []string{"*"},
+				ExcludeResources: []string{"events"},
+			},
+		},
+		{
+			name:          "wildcard in excludes should fail",
+			errorExpected: true,
+			scanType: ScanType{
+				APIGroups:        []string{"*"},
+				Resources:        []string{"*"},
+				ExcludeResources: []string{"*"},
+			},
+		},
+		{
+			name:          "known update predicates should be valid",
+			errorExpected: false,
+			scanType: ScanType{
+				APIGroups:        []string{"apps"},
+				Resources:        []string{"deployments"},
+				UpdatePredicates: []UpdatePredicate{UpdatePredicateGenerationChanged, UpdatePredicateLabelsChanged},
+			},
+		},
+		{
+			name:          "unknown update predicate should fail",
+			errorExpected: true,
+			scanType: ScanType{
+				APIGroups:        []string{"apps"},
+				Resources:        []string{"deployments"},
+				UpdatePredicates: []UpdatePredicate{"specChanged"},
+			},
+		},
+		{
+			name:          "ignoreStatus for metadata-only scan types should fail",
+			errorExpected: true,
+			scanType: ScanType{
+				APIGroups:        []string{""},
+				Resources:        []string{"pods"},
+				MetadataOnly:     true,
+				UpdatePredicates: []UpdatePredicate{UpdatePredicateIgnoreStatus},
+			},
+		},
+		{
+			name:          "selectors should be valid",
+			errorExpected: false,
+			scanType: ScanType{
+				APIGroups:     []string{""},
+				Resources:     []string{"pods"},
+				LabelSelector: "app.kubernetes.io/managed-by!=Helm,team in (payments, ledger)",
+				FieldSelector: "metadata.namespace!=kube-system,metadata.name!=default",
+			},
+		},
+		{
+			name:          "field selector on fields that are not supported by all resources should fail",
+			errorExpected: true,
+			scanType: ScanType{
+				APIGroups:     []string{""},
+				Resources:     []string{"pods"},
+				FieldSelector: "status.phase=Running",
+			},
+		},
+		{
+			name:          "invalid label selector should fail",
+			errorExpected: true,
+			scanType: ScanType{
+				APIGroups:     []string{""},
+				Resources:     []string{"pods"},
+				LabelSelector: "team in (payments",
+			},
+		},
+		{
+			name:          "invalid field selector should fail",
+			errorExpected: true,
+			scanType: ScanType{
+				APIGroups:     []string{""},
+				Resources:     []string{"pods"},
+				FieldSelector: "status.phase",
+			},
+		},
+	} {
+		t.Run(tc.name, func(tt *testing.T) {
+			err := tc.scanType.validate()
+			if tc.errorExpected {
+				require.Error(tt, err)
+			} else {
+				require.NoError(tt, err)
+			}
+		})
+	}
+}
+
 func TestGetGVKs(t *testing.T) {
 	testTypes := map[string]struct {
 		scanType     ScanType
@@ -256,15 +740,104 @@ func TestGetGVKs(t *testing.T) {
 				},
 			}},
 		},
+		"wildcard-resources": {
+			scanType: ScanType{
+				APIGroups: []string{"networking.gke.io"},
+				Resources: []string{"*"},
+			},
+			expectedGVKs: []GroupVersionKind{{
+				PreferredVersion: "v1",
+				GroupVersionKind: schema.GroupVersionKind{
+					Group:   "networking.gke.io",
+					Version: "v1",
+					Kind:    "ServiceAttachment",
+				},
+			}, {
+				PreferredVersion: "v1",
+				GroupVersionKind: schema.GroupVersionKind{
+					Group:   "networking.gke.io",
+					Version: "v1",
+					Kind:    "ManagedCertificate",
+				},
+			}, {
+				PreferredVersion: "v1",
+				GroupVersionKind: schema.GroupVersionKind{
+					Group:   "networking.gke.io",
+					Version: "v1beta1",
+					Kind:    "FrontendConfig",
+				},
+			}, {
+				PreferredVersion: "v1",
+				GroupVersionKind: schema.GroupVersionKind{
+					Group:   "networking.gke.io",
+					Version: "v1beta1",
+					Kind:    "ServiceNetworkEndpointGroup",
+				},
+			}},
+		},
+		"wildcard-resources-with-excludes": {
+			scanType: ScanType{
+				APIGroups:        []string{"networking.gke.io"},
+				Versions:         []string{"v1"},
+				Resources:        []string{"*"},
+				ExcludeResources: []string{"managedcertificates"},
+			},
+			expectedGVKs: []GroupVersionKind{{
+				PreferredVersion: "v1",
+				GroupVersionKind: schema.GroupVersionKind{
+					Group:   "networking.gke.io",
+					Version: "v1",
+					Kind:    "ServiceAttachment",
+				},
+			}},
+		},
+		"wildcard-skips-unwatchable-resources": {
+			scanType: ScanType{
+				APIGroups: []string{"authorization.k8s.io"},
+				Resources: []string{"*"},
+			},
+			expectedGVKs: nil,
+		},
+		"unwatchable-resource": {
+			scanType: ScanType{
+				APIGroups: []string{"authorization.k8s.io"},
+				Resources: []string{"subjectaccessreviews"},
+			},
+			expectedGVKs: nil,
+		},
+		"wildcard-groups": {
+			scanType: ScanType{
+				APIGroups:        []string{"*"},
+				Versions:         []string{"v1"},
+				Resources:        []string{"*"},
+				ExcludeResources: []string{"csidrivers", "serviceattachments", "managedcertificates", "horizontalpodautoscalers", "scales"},
+			},
+			expectedGVKs: []GroupVersionKind{{
+				PreferredVersion: "v1",
+				GroupVersionKind: schema.GroupVersionKind{
+					Group:   "apps",
+					Version: "v1",
+					Kind:    "Deployment",
+				},
+			}, {
+				PreferredVersion: "v1",
+				GroupVersionKind: schema.GroupVersionKind{
+					Group:   "",
+					Version: "v1",
+					Kind:    "Pod",
+				},
+			}},
+		},
 	}
 	fakeLog := zap.New(zap.UseDevMode(true))
 	fakeDiscovery := &fakeDiscovery{
 		groupVersions: map[string][]string{
-			"apps":              {"v1"},
-			"":                  {"v1"},
-			"storage.k8s.io":    {"v1", "v1beta1"},
-			"autoscaling":       {"v2", "v1"},
-			"networking.gke.io": {"v1", "v1beta1"},
+			"apps":                 {"v1"},
+			"":                     {"v1"},
+			"storage.k8s.io":       {"v1", "v1beta1"},
+			"autoscaling":          {"v2", "v1"},
+			"networking.gke.io":    {"v1", "v1beta1"},
+			"authorization.k8s.io": {"v1"},
 		},
 		gvrToKind: map[schema.GroupVersionResource]string{
 			{Group: "apps", Version: "v1", Resource: "deployments"}: "Deployment",
@@ -290,6 +863,13 @@ func TestGetGVKs(t *testing.T) {
 			{Group: "networking.gke.io", Version: "v1beta1", Resource: "serviceattachments"}: "ServiceAttachment",
 			{Group: "networking.gke.io", Version: "v1", Resource: "managedcertificates"}:     "ManagedCertificate",
 			{Group: "networking.gke.io", Version: "v1", Resource: "serviceattachments"}:      "ServiceAttachment",
+			{Group: "authorization.k8s.io", Version: "v1", Resource: "subjectaccessreviews"}: "SubjectAccessReview",
+			{Group: "authorization.k8s.io", Version: "v1", Resource: "selfsubjectreviews"}:   "SelfSubjectReview",
+			{Group: "", Version: "v1", Resource: "pods/log"}:                                 "Pod",
+		},
+		unwatchable: []schema.GroupVersionResource{
+			{Group: "authorization.k8s.io", Version: "v1", Resource: "subjectaccessreviews"},
+			{Group: "authorization.k8s.io", Version: "v1", Resource: "selfsubjectreviews"},
 		},
 	}
 
@@ -305,6 +885,12 @@ func TestGetGVKs(t *testing.T) {
 type fakeDiscovery struct {
 	groupVersions map[string][]string
 	gvrToKind     map[schema.GroupVersionResource]string
+	// unwatchable resources do not support the list and watch verbs.
+	unwatchable []schema.GroupVersionResource
+	// clusterScoped resources are not namespaced.
+	clusterScoped []schema.GroupVersionResource
+	// failing groupversions return their error when their resources are discovered.
+	failing map[schema.GroupVersion]error
 }
 
 func (fd *fakeDiscovery) versionsForGroup(group string) ([]string, error) {
@@ -319,12 +905,91 @@ func (fd *fakeDiscovery) findGroupPreferredVersion(group string) (string, error)
 	return "v1", nil
 }
 
-func (fd *fakeDiscovery) findGVK(gvr schema.GroupVersionResource) (schema.GroupVersionKind, error) {
-	kind, ok := fd.gvrToKind[gvr]
-	if !ok {
-		return schema.GroupVersionKind{}, newNotFoundError(gvr)
+func (fd *fakeDiscovery) groups() []string {
+	groups := make([]string, 0, len(fd.groupVersions))
+	for group := range fd.groupVersions {
+		groups = append(groups, group)
 	}
-	return gvr.GroupVersion().WithKind(kind), nil
+	return groups
+}
+
+func (fd *fakeDiscovery) resourcesForGroupVersion(gv schema.GroupVersion) ([]metav1.APIResource, error) {
+	if err, ok := fd.failing[gv]; ok {
+		return nil, err
+	}
+
+	var resources []metav1.APIResource
+	for gvr, kind := range fd.gvrToKind {
+		if gvr.GroupVersion() != gv {
+			continue
+		}
+
+		verbs := []string{"get", "list", "watch"}
+		if slices.Contains(fd.unwatchable, gvr) {
+			verbs = []string{"create"}
+		}
+		resources = append(resources, metav1.APIResource{
+			Name:       gvr.Resource,
+			Kind:       kind,
+			Verbs:      verbs,
+			Namespaced: !slices.Contains(fd.clusterScoped, gvr),
+		})
+	}
+	if len(resources) == 0 {
+		return nil, newNotFoundError(gv.WithResource(""))
+	}
+	return resources, nil
+}
+
+func TestGetGVKsWithFailingGroup(t *testing.T) {
+	fakeDiscovery := &fakeDiscovery{
+		groupVersions: map[string][]string{
+			"":               {"v1"},
+			"metrics.k8s.io": {"v1beta1"},
+		},
+		gvrToKind: map[schema.GroupVersionResource]string{
+			{Group: "", Version: "v1", Resource: "pods"}:                    "Pod",
+			{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "pods"}: "PodMetrics",
+		},
+		failing: map[schema.GroupVersion]error{
+			{Group: "metrics.k8s.io", Version: "v1beta1"}: k8serrors.NewServiceUnavailable("the server is currently unable to handle the request"),
+		},
+	}
+	fakeLog := zap.New(zap.UseDevMode(true))
+
+	gvks, err := ScanType{APIGroups: []string{"*"}, Resources: []string{"*"}}.GetGVKs(fakeDiscovery, fakeLog)
+	require.NoError(t, err, "groups of the wildcard that fail discovery should be skipped")
+	require.Equal(t, []GroupVersionKind{{
+		PreferredVersion: "v1",
+		GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "Pod"},
+	}}, gvks)
+
+	_, err = ScanType{APIGroups: []string{"", "metrics.k8s.io"}, Resources: []string{"*"}}.GetGVKs(fakeDiscovery, fakeLog)
+	require.True(t, k8serrors.IsServiceUnavailable(err), "explicitly selected groups should fail, got %v", err)
+}
+
+func TestIsNamespaced(t *testing.T) {
+	fakeDiscovery := &fakeDiscovery{
+		gvrToKind: map[schema.GroupVersionResource]string{
+			{Group: "", Version: "v1", Resource: "pods"}:       "Pod",
+			{Group: "", Version: "v1", Resource: "pods/log"}:   "Pod",
+			{Group: "", Version: "v1", Resource: "namespaces"}: "Namespace",
+		},
+		clusterScoped: []schema.GroupVersionResource{
+			{Group: "", Version: "v1", Resource: "namespaces"},
+		},
+	}
+
+	namespaced, err := IsNamespaced(fakeDiscovery, schema.GroupVersionKind{Version: "v1", Kind: "Pod"})
+	require.NoError(t, err)
+	require.True(t, namespaced)
+
+	namespaced, err = IsNamespaced(fakeDiscovery, schema.GroupVersionKind{Version: "v1", Kind: "Namespace"})
+	require.NoError(t, err)
+	require.False(t, namespaced)
+
+	_, err = IsNamespaced(fakeDiscovery, schema.GroupVersionKind{Version: "v1", Kind: "Node"})
+	require.True(t, k8serrors.IsNotFound(err))
 }
 
 func TestConfigOrganizations(t *testing.T) {
@@ -333,7 +998,9 @@ func TestConfigOrganizations(t *testing.T) {
 			{OrganizationID: "a"},
 			{OrganizationID: "b"},
 			{OrganizationID: "a"},
+			{OrganizationIDAnnotation: "snyk.io/org-id", AllowedOrganizationIDs: []string{"b", "c"}},
+			{OrganizationIDAnnotation: "snyk.io/other-org-id"},
 		},
 	}
-	require.Equal(t, []string{"a", "b"}, cfg.Organizations())
+	require.Equal(t, []string{"a", "b", "c"}, cfg.Organizations())
 }
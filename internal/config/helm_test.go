@@ -125,7 +125,8 @@ func checkConfigMap(t *testing.T, cm *corev1.ConfigMap) {
 		},
 		},
 		Scanning: Scan{
-			RequeueAfter: metav1.Duration{Duration: 6 * time.Hour},
+			RequeueAfter:      metav1.Duration{Duration: 6 * time.Hour},
+			DiscoveryInterval: metav1.Duration{Duration: 5 * time.Minute},
 			Types: []ScanType{{
 				APIGroups: []string{""},
 				Versions:  []string{"*"},
@@ -144,10 +145,47 @@ func checkConfigMap(t *testing.T, cm *corev1.ConfigMap) {
 				Interval: metav1.Duration{Duration: 10 * time.Second},
 				MaxSize:  50,
 			},
+			Spool: Spool{
+				Enabled:           false,
+				Directory:         "/var/spool/kubernetes-scanner",
+				MaxBytes:          100 << 20,
+				MaxAge:            metav1.Duration{Duration: 24 * time.Hour},
+				EvictionPolicy:    "dropOldest",
+				ReplayInterval:    metav1.Duration{Duration: 30 * time.Second},
+				MaxReplayInterval: metav1.Duration{Duration: 10 * time.Minute},
+			},
+			RateLimit: RateLimit{
+				RequestsPerSecond:    0,
+				MinRequestsPerSecond: 0.1,
+				Burst:                10,
+			},
 		},
 		Logging: Logging{
 			Level: "warn",
 		},
+		ReloadInterval: metav1.Duration{Duration: 30 * time.Second},
+		LeaderElection: LeaderElection{
+			Enabled:       false,
+			LeaseName:     "test-render-kubernetes-scanner",
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+		Sharding: Sharding{
+			Enabled:       false,
+			GroupName:     "test-render-kubernetes-scanner",
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewInterval: metav1.Duration{Duration: 5 * time.Second},
+		},
+		NamespaceScope: NamespaceScope{
+			Enabled:    false,
+			Namespaces: []string{},
+		},
+		RoutingState: RoutingState{
+			Enabled:       false,
+			ConfigMapName: "test-render-kubernetes-scanner-routing",
+			SyncInterval:  metav1.Duration{Duration: 30 * time.Second},
+		},
 	}
 	// these are just *some* GVKs, not all of them.
 	expectedGVKs := [][]GroupVersionKind{
@@ -192,10 +230,26 @@ func checkConfigMap(t *testing.T, cm *corev1.ConfigMap) {
 		require.Contains(t, cfg.Scanning.Types, typ)
 	}
 	require.Equal(t, expected.Scanning.RequeueAfter, cfg.Scanning.RequeueAfter)
+	require.Equal(t, expected.Scanning.DiscoveryInterval, cfg.Scanning.DiscoveryInterval)
+	require.Equal(t, expected.Scanning.ResendUnchangedAfter, cfg.Scanning.ResendUnchangedAfter)
+	require.Equal(t, expected.Scanning.DeletionDetectionInterval, cfg.Scanning.DeletionDetectionInterval)
 	require.Equal(t, expected.MetricsAddress, cfg.MetricsAddress)
 	require.Equal(t, expected.ProbeAddress, cfg.ProbeAddress)
 	require.Equal(t, expected.Egress, cfg.Egress)
 	require.Equal(t, expected.Logging, cfg.Logging)
+	require.Equal(t, expected.ReloadInterval, cfg.ReloadInterval)
+	// the lease namespaces are the release namespace, which depends on the rendering environment.
+	require.NotEmpty(t, cfg.LeaderElection.LeaseNamespace)
+	cfg.LeaderElection.LeaseNamespace = ""
+	require.Equal(t, expected.LeaderElection, cfg.LeaderElection)
+	require.NotEmpty(t, cfg.Sharding.LeaseNamespace)
+	cfg.Sharding.LeaseNamespace = ""
+	require.Equal(t, expected.Sharding, cfg.Sharding)
+	require.Equal(t, expected.NamespaceScope, cfg.NamespaceScope)
+	// like the lease namespace, the namespace of the config map is the release namespace.
+	require.NotEmpty(t, cfg.RoutingState.ConfigMapNamespace)
+	cfg.RoutingState.ConfigMapNamespace = ""
+	require.Equal(t, expected.RoutingState, cfg.RoutingState)
 
 	d, err := cfg.Discovery()
 	if err != nil {
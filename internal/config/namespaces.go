@@ -0,0 +1,165 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// NamespaceMatcher matches namespaces against a list of namespace patterns, except for the ones
+// matching any of the excluded patterns. A pattern is either:
+//   - the exact name of a namespace, e.g. "default".
+//   - a glob pattern, e.g. "team-*-prod", where "*" matches any sequence of characters, "?" matches
+//     a single character and "[a-z]" matches a character class.
+//   - a regular expression enclosed in slashes, e.g. "/preview-pr-[0-9]+/", which has to match the
+//     whole name of the namespace.
+type NamespaceMatcher struct {
+	// all is set if all namespaces are included.
+	all     bool
+	include []namespacePattern
+	exclude []namespacePattern
+}
+
+type namespacePattern struct {
+	// exactly one of these is set.
+	name string
+	glob string
+	re   *regexp.Regexp
+}
+
+func compileNamespacePattern(pattern string) (namespacePattern, error) {
+	switch {
+	case pattern == "":
+		return namespacePattern{}, fmt.Errorf("empty namespace pattern")
+
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return namespacePattern{}, fmt.Errorf("could not compile namespace pattern %q: %w", pattern, err)
+		}
+		return namespacePattern{re: re}, nil
+
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return namespacePattern{}, fmt.Errorf("could not compile namespace pattern %q: %w", pattern, err)
+		}
+		return namespacePattern{glob: pattern}, nil
+
+	default:
+		return namespacePattern{name: pattern}, nil
+	}
+}
+
+func (p namespacePattern) matches(namespace string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(namespace)
+	case p.glob != "":
+		// the pattern has been validated when compiling it.
+		matched, _ := path.Match(p.glob, namespace)
+		return matched
+	default:
+		return p.name == namespace
+	}
+}
+
+// newNamespaceMatcher compiles the given patterns. If all is set, the included patterns are
+// ignored and all namespaces but the excluded ones are matched.
+func newNamespaceMatcher(all bool, include, exclude []string) (*NamespaceMatcher, error) {
+	m := &NamespaceMatcher{all: all}
+	if !all {
+		for _, pattern := range include {
+			p, err := compileNamespacePattern(pattern)
+			if err != nil {
+				return nil, err
+			}
+			m.include = append(m.include, p)
+		}
+	}
+
+	for _, pattern := range exclude {
+		p, err := compileNamespacePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid excluded namespace: %w", err)
+		}
+		m.exclude = append(m.exclude, p)
+	}
+	return m, nil
+}
+
+// Matches returns true if the given namespace matches any of the included patterns and none of the
+// excluded ones.
+func (m *NamespaceMatcher) Matches(namespace string) bool {
+	if m.Excludes(namespace) {
+		return false
+	}
+	if m.all {
+		return true
+	}
+	for _, p := range m.include {
+		if p.matches(namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// Excludes returns true if the given namespace matches any of the excluded patterns.
+func (m *NamespaceMatcher) Excludes(namespace string) bool {
+	for _, p := range m.exclude {
+		if p.matches(namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// Names returns the exact names of all namespaces that might be matched. Returns false if the
+// matcher contains patterns or includes all namespaces, in which case any namespace might match.
+func (m *NamespaceMatcher) Names() ([]string, bool) {
+	if m.all {
+		return nil, false
+	}
+
+	names := []string{}
+	for _, p := range m.include {
+		if p.name == "" {
+			return nil, false
+		}
+		names = append(names, p.name)
+	}
+	return names, true
+}
+
+// NamespaceMatcher returns the matcher for the namespaces of the scan type. If no namespaces are
+// set, all namespaces are matched.
+func (st ScanType) NamespaceMatcher() (*NamespaceMatcher, error) {
+	return newNamespaceMatcher(st.Namespaces == nil, st.Namespaces, st.ExcludeNamespaces)
+}
+
+// NamespaceMatcher returns the matcher for the namespaces of the route. If the namespaces contain
+// the "*" wildcard, all namespaces are matched. Namespaces that are routed by the namespace
+// selector or annotation of the route are not part of the matcher, only the excluded ones.
+func (r Route) NamespaceMatcher() (*NamespaceMatcher, error) {
+	all := false
+	for _, ns := range r.Namespaces {
+		all = all || ns == Wildcard
+	}
+	return newNamespaceMatcher(all, r.Namespaces, r.ExcludeNamespaces)
+}
@@ -0,0 +1,107 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		all        bool
+		include    []string
+		exclude    []string
+		matches    []string
+		notMatches []string
+		names      []string
+	}{
+		{
+			name:       "exact names",
+			include:    []string{"default", "team-a"},
+			matches:    []string{"default", "team-a"},
+			notMatches: []string{"team-b", "default-2"},
+			names:      []string{"default", "team-a"},
+		},
+		{
+			name:       "glob",
+			include:    []string{"team-*-prod", "app-?"},
+			matches:    []string{"team-payments-prod", "team--prod", "app-1"},
+			notMatches: []string{"team-payments-dev", "app-12"},
+		},
+		{
+			name:       "regex",
+			include:    []string{"/preview-pr-[0-9]+/"},
+			matches:    []string{"preview-pr-1", "preview-pr-1234"},
+			notMatches: []string{"preview-pr-", "preview-pr-12a", "x-preview-pr-1"},
+		},
+		{
+			name:       "all with excludes",
+			all:        true,
+			exclude:    []string{"kube-*", "/preview-.*/"},
+			matches:    []string{"default", "team-a"},
+			notMatches: []string{"kube-system", "preview-pr-1"},
+		},
+		{
+			name:       "patterns with excludes",
+			include:    []string{"team-*"},
+			exclude:    []string{"team-sandbox"},
+			matches:    []string{"team-payments"},
+			notMatches: []string{"team-sandbox", "default"},
+		},
+		{
+			name:       "none",
+			include:    []string{},
+			notMatches: []string{"default"},
+			names:      []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := newNamespaceMatcher(tc.all, tc.include, tc.exclude)
+			require.NoError(t, err)
+			for _, ns := range tc.matches {
+				require.True(t, m.Matches(ns), "%v should match", ns)
+			}
+			for _, ns := range tc.notMatches {
+				require.False(t, m.Matches(ns), "%v should not match", ns)
+			}
+
+			names, ok := m.Names()
+			require.Equal(t, tc.names != nil, ok)
+			require.Equal(t, tc.names, names)
+		})
+	}
+}
+
+func TestNamespaceMatcherValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		include []string
+		exclude []string
+	}{
+		{name: "invalid regex", include: []string{"/preview-(/"}},
+		{name: "invalid glob", include: []string{"team-[a"}},
+		{name: "invalid exclude", exclude: []string{"/preview-(/"}},
+		{name: "empty pattern", include: []string{""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newNamespaceMatcher(false, tc.include, tc.exclude)
+			require.Error(t, err)
+		})
+	}
+}
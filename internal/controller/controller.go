@@ -19,6 +19,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -28,55 +30,222 @@ import (
 	"github.com/snyk/kubernetes-scanner/internal/config"
 	"github.com/snyk/kubernetes-scanner/internal/kubeobjects"
 	"github.com/snyk/kubernetes-scanner/internal/retry"
+	"github.com/snyk/kubernetes-scanner/internal/sharding"
 	"golang.org/x/exp/slices"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 func New(cfg *config.Config, s Store) (manager.Manager, error) {
 	ctrl.Log.Info("creating manager")
-	mgr, err := ctrl.NewManager(cfg.RestConfig, ctrl.Options{
+	opts := ctrl.Options{
 		Scheme:                 cfg.Scheme,
 		Metrics:                metricsserver.Options{BindAddress: cfg.MetricsAddress},
 		HealthProbeBindAddress: cfg.ProbeAddress,
-	})
+	}
+	setLeaderElectionOptions(&opts, cfg.LeaderElection)
+
+	// the transform is populated once the GVKs have been discovered, before the cache is started.
+	transform := &cacheTransform{}
+	opts.Cache.DefaultTransform = transform.transform
+
+	// the cached namespaces are fixed for the lifetime of the manager.
+	cached := cacheNamespaces(cfg)
+	switch {
+	case cached == nil:
+	case len(cached) == 0:
+		ctrl.Log.Info("not scanning namespaced resources, as no namespace is both scanned and routed")
+	default:
+		ctrl.Log.Info("restricting cache to namespaces", "namespaces", cached)
+		setCacheOptions(&opts.Cache, cached)
+	}
+
+	// TODO: we depend on the logger being setup implicitly...
+	discover := func(cfg *config.Config) (map[reconcilerKey]config.ScanType, error) {
+		return discoverReconcilers(cfg, cached, log.Log)
+	}
+	// the initial discovery is run synchronously so that invalid scan types still fail the startup.
+	desired, err := discover(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("unable to start manager: %w", err)
+		return nil, err
 	}
 
-	ctrl.Log.Info("creating discovery client")
-	discovery, err := cfg.Discovery()
+	// like the namespaces, the selectors of the informers can only be set when creating the
+	// manager. Selectors of types that are discovered later on are only enforced by the reconciler.
+	opts.Cache.ByObject = cacheSelectors(desired)
+
+	mgr, err := ctrl.NewManager(cfg.RestConfig, opts)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create discovery client: %w", err)
+		return nil, fmt.Errorf("unable to start manager: %w", err)
 	}
 
-	for _, scanType := range cfg.Scanning.Types {
-		// TODO: we depend on the logger being setup implicitly...
-		gvks, err := scanType.GetGVKs(discovery, log.Log)
-		if err != nil {
-			return nil, fmt.Errorf("could not get GVK: %w", err)
+	// the batcher is shared between all reconcilers and only sends data once this replica has been
+	// elected as the leader.
+	var sent *sentResources
+	if d := cfg.Scanning.ResendUnchangedAfter.Duration; d > 0 {
+		sent = newSentResources(d)
+	}
+	var spool *spooler
+	if cfg.Egress.Spool.Enabled {
+		if spool, err = newSpooler(cfg.Egress.Spool, s, log.Log); err != nil {
+			return nil, fmt.Errorf("unable to setup spool: %w", err)
 		}
+		if err := mgr.Add(spool); err != nil {
+			return nil, fmt.Errorf("unable to add spool to manager: %w", err)
+		}
+	}
+	upsertBatcher := newUpsertBatcher(cfg, log.Log, s, sent, spool)
+	if err := mgr.Add(upsertBatcher); err != nil {
+		return nil, fmt.Errorf("unable to add batcher to manager: %w", err)
+	}
 
-		for _, gvk := range gvks {
-			if err := (&reconciler{
-				Reader:        mgr.GetClient(),
-				requeueAfter:  cfg.Scanning.RequeueAfter.Duration,
-				upsertBatcher: newUpsertBatcher(cfg, log.Log, s),
-				gvk:           gvk,
-				routes:        newResourceRoutes(cfg.Routes),
-				namespaces:    scanType.Namespaces,
-				pathsToRemove: scanType.PathsToRemove,
-			}).SetupWithManager(mgr); err != nil {
-				return nil, fmt.Errorf("unable to create controller for GVK %v: %w", gvk, err)
+	var shard *sharding.Sharder
+	if cfg.Sharding.Enabled {
+		if shard, err = newSharder(cfg); err != nil {
+			return nil, fmt.Errorf("unable to setup sharding: %w", err)
+		}
+		if err := mgr.Add(shard); err != nil {
+			return nil, fmt.Errorf("unable to add sharder to manager: %w", err)
+		}
+	}
+
+	// the routed organizations are only needed to persist them.
+	var routed *routedOrganizations
+	var routingState *routingStateStore
+	if cfg.RoutingState.Enabled {
+		routed = newRoutedOrganizations()
+		routingState = &routingStateStore{
+			reader: mgr.GetAPIReader(),
+			writer: mgr.GetClient(),
+			key: types.NamespacedName{
+				Namespace: cfg.RoutingState.ConfigMapNamespace,
+				Name:      cfg.RoutingState.ConfigMapName,
+			},
+			interval: cfg.RoutingState.SyncInterval.Duration,
+			routed:   routed,
+			log:      log.Log,
+			restored: make(chan struct{}),
+		}
+	}
+
+	// the namespaces are read from the cache, which requires watching them cluster-wide. Without
+	// cluster-wide permissions, they can only be read one by one.
+	var namespaceReader client.Reader = mgr.GetCache()
+	if cfg.NamespaceScope.Enabled {
+		namespaceReader = mgr.GetAPIReader()
+	}
+
+	newSettings := func(cfg *config.Config, gvk config.GroupVersionKind) reconcilerSettings {
+		return reconcilerSettings{
+			routes:       newResourceRoutes(cfg.Routes, resourceOf(mgr, gvk), namespaceReader),
+			requeueAfter: cfg.Scanning.RequeueAfter.Duration,
+		}
+	}
+	rs := &reconcilers{
+		log:      log.Log,
+		interval: cfg.Scanning.DiscoveryInterval.Duration,
+		discover: discover,
+		newReconciler: func(cfg *config.Config, scanType config.ScanType, gvk config.GroupVersionKind) *reconciler {
+			r := &reconciler{
+				Reader:          mgr.GetClient(),
+				cache:           mgr.GetCache(),
+				settings:        newSettings(cfg, gvk),
+				upsertBatcher:   upsertBatcher,
+				sent:            sent,
+				gvk:             gvk,
+				cached:          cached,
+				pathsToRemove:   scanType.PathsToRemove,
+				predicates:      newUpdatePredicates(scanType.UpdatePredicates),
+				metadataOnly:    scanType.MetadataOnly,
+				tombstones:      newTombstones(),
+				namespaceReader: namespaceReader,
+				routed:          routed,
+				resync:          make(chan event.GenericEvent),
+				failures:        newFailedUpserts(time.Second, 5*time.Minute),
 			}
+			// the selectors and namespaces have been validated when reading the config.
+			r.labelSelector, r.fieldSelector, _ = scanType.Selectors()
+			r.namespaces, _ = scanType.NamespaceMatcher()
+			if shard != nil {
+				r.shard = shard
+			}
+			return r
+		},
+		newSettings: newSettings,
+		setup: func(r *reconciler, name string) (controller.Controller, error) {
+			return r.SetupWithManager(mgr, name)
+		},
+		informers: mgr.GetCache(),
+		transform: transform,
+		started:   make(chan struct{}),
+		cfg:       cfg,
+		desired:   desired,
+		running:   map[reconcilerKey]*runningReconciler{},
+	}
+	if routingState != nil {
+		// reconcilers need to know where objects have been routed to before they are started.
+		rs.ready = routingState.restored
+		routingState.rs = rs
+		if err := mgr.Add(routingState); err != nil {
+			return nil, fmt.Errorf("unable to add routing state to manager: %w", err)
+		}
+	}
+	if err := mgr.Add(rs); err != nil {
+		return nil, fmt.Errorf("unable to add reconcilers to manager: %w", err)
+	}
+
+	if !cfg.NamespaceScope.Enabled {
+		if err := mgr.Add(&namespaceWatcher{cache: mgr.GetCache(), rs: rs, log: log.Log}); err != nil {
+			return nil, fmt.Errorf("unable to add namespace watcher to manager: %w", err)
+		}
+	}
+
+	if shard != nil {
+		if err := mgr.Add(resyncOnShardChange(shard, rs)); err != nil {
+			return nil, fmt.Errorf("unable to add shard rebalancing to manager: %w", err)
+		}
+	}
+
+	if d := cfg.Scanning.DeletionDetectionInterval.Duration; d > 0 {
+		if err := mgr.Add(&deletionDetector{
+			store:       s,
+			clusterName: cfg.ClusterName,
+			rs:          rs,
+			interval:    d,
+			log:         log.Log,
+		}); err != nil {
+			return nil, fmt.Errorf("unable to add deletion detection to manager: %w", err)
+		}
+	}
+
+	if cfg.Path() != "" && cfg.ReloadInterval.Duration > 0 {
+		if err := mgr.Add(&configReloader{
+			cfg:      cfg,
+			interval: cfg.ReloadInterval.Duration,
+			apply:    rs.reload,
+			log:      log.Log,
+			checksum: cfg.Checksum(),
+		}); err != nil {
+			return nil, fmt.Errorf("unable to add config reloader to manager: %w", err)
 		}
 	}
 
@@ -91,71 +260,360 @@ func New(cfg *config.Config, s Store) (manager.Manager, error) {
 	return mgr, nil
 }
 
+// resourceOf returns the group and resource of the given GVK, which routes are restricted by. The
+// resource is empty if it can't be found.
+func resourceOf(mgr manager.Manager, gvk config.GroupVersionKind) schema.GroupResource {
+	mapping, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		log.Log.Error(err, "could not get resource of GVK, skipping routes restricted to types", "gvk", gvk)
+		return schema.GroupResource{Group: gvk.Group}
+	}
+	return mapping.Resource.GroupResource()
+}
+
+// setLeaderElectionOptions configures the manager's leader election. Leader election is only
+// active if it has been enabled; controllers and other runnables that need leader election will then
+// only be started on the elected leader.
+func setLeaderElectionOptions(opts *ctrl.Options, le config.LeaderElection) {
+	if !le.Enabled {
+		return
+	}
+
+	opts.LeaderElection = true
+	opts.LeaderElectionID = le.LeaseName
+	opts.LeaderElectionNamespace = le.LeaseNamespace
+	// releasing the lease on shutdown allows standby replicas to take over immediately instead of
+	// waiting for the lease to expire.
+	opts.LeaderElectionReleaseOnCancel = true
+	if d := le.LeaseDuration.Duration; d != 0 {
+		opts.LeaseDuration = &d
+	}
+	if d := le.RenewDeadline.Duration; d != 0 {
+		opts.RenewDeadline = &d
+	}
+	if d := le.RetryPeriod.Duration; d != 0 {
+		opts.RetryPeriod = &d
+	}
+}
+
+// discoverReconcilers returns the reconcilers for all GVKs of the configured scan types that are
+// currently available on the server. Namespaced resources are skipped if no namespace is cached.
+func discoverReconcilers(cfg *config.Config, cached []string, logger logr.Logger) (map[reconcilerKey]config.ScanType, error) {
+	discovery, err := cfg.Discovery()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create discovery client: %w", err)
+	}
+
+	// the cache would not be restricted to any namespace otherwise.
+	noneCached := cached != nil && len(cached) == 0
+	desired := map[reconcilerKey]config.ScanType{}
+	for i, scanType := range cfg.Scanning.Types {
+		gvks, err := scanType.GetGVKs(discovery, logger)
+		if err != nil {
+			return nil, fmt.Errorf("could not get GVK: %w", err)
+		}
+
+		for _, gvk := range gvks {
+			if cfg.NamespaceScope.Enabled || noneCached {
+				namespaced, err := config.IsNamespaced(discovery, gvk.GroupVersionKind)
+				if err != nil {
+					return nil, fmt.Errorf("could not get scope of GVK %v: %w", gvk.GroupVersionKind, err)
+				}
+				if !namespaced && cfg.NamespaceScope.Enabled {
+					logger.Info("skipping cluster-scoped resource type as the scanner is restricted to namespaces",
+						"gvk", gvk.GroupVersionKind)
+					continue
+				}
+				if namespaced && noneCached {
+					logger.Info("skipping namespaced resource type as no namespace is both scanned and routed",
+						"gvk", gvk.GroupVersionKind)
+					continue
+				}
+			}
+			desired[reconcilerKey{scanType: i, gvk: gvk}] = scanType
+		}
+	}
+	return desired, nil
+}
+
+func newSharder(cfg *config.Config) (*sharding.Sharder, error) {
+	// the sharder must not use the manager's client, as that would setup a cluster-wide informer
+	// for Leases.
+	c, err := client.New(cfg.RestConfig, client.Options{Scheme: cfg.Scheme})
+	if err != nil {
+		return nil, fmt.Errorf("could not create client: %w", err)
+	}
+
+	// within a Deployment, the hostname is the name of the pod.
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("could not get hostname: %w", err)
+	}
+
+	return sharding.New(c, sharding.Config{
+		Group:         cfg.Sharding.GroupName,
+		Identity:      identity,
+		Namespace:     cfg.Sharding.LeaseNamespace,
+		LeaseDuration: cfg.Sharding.LeaseDuration.Duration,
+		RenewInterval: cfg.Sharding.RenewInterval.Duration,
+	}, log.Log), nil
+}
+
+// resyncOnShardChange enqueues the objects of all reconcilers whenever the assignment of
+// namespaces to replicas changed. Objects in namespaces that this replica took over would otherwise
+// only be reconciled on their next change.
+func resyncOnShardChange(shard *sharding.Sharder, rs *reconcilers) manager.RunnableFunc {
+	return func(ctx context.Context) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-shard.Changed():
+			}
+
+			rs.each(func(ctx context.Context, r *reconciler) {
+				if err := r.enqueueAll(ctx); err != nil {
+					log.FromContext(ctx).Error(err, "could not enqueue objects after shard change", "gvk", r.gvk)
+				}
+			})
+		}
+	}
+}
+
+// shard decides whether a namespace is owned by this replica.
+type shard interface {
+	Owns(namespace string) bool
+}
+
 type reconciler struct {
 	client.Reader
-	requeueAfter  time.Duration
+	// cache is the informer cache of the manager.
+	cache client.Reader
+	// settingsLock guards the settings, which are swapped when the config is reloaded.
+	settingsLock  sync.Mutex
+	settings      reconcilerSettings
 	gvk           config.GroupVersionKind
-	upsertBatcher *batcher.Batcher[string, backend.Resource]
-	namespaces    []string
-	routes        resourceRoutes
+	upsertBatcher *batcher.Batcher[string, upsert]
+	// sent is nil if unchanged resources should always be sent.
+	sent       *sentResources
+	namespaces *config.NamespaceMatcher
+	// cached is nil if all namespaces are cached.
+	cached        []string
 	pathsToRemove []string
+	// labelSelector and fieldSelector restrict the reconciled objects, as not all informers
+	// can be restricted.
+	labelSelector labels.Selector
+	fieldSelector fields.Selector
+	// predicates filter the events of the watch. Objects that are resynced or requeued are
+	// reconciled regardless.
+	predicates []predicate.Predicate
+	// metadataOnly is set if only the metadata of objects is cached; objects are always fetched
+	// from the API server when reconciling.
+	metadataOnly bool
+	// tombstones hold the last known state of deleted objects.
+	tombstones *tombstones
+	// namespaceReader is used to check whether the namespace of an object opted out of scanning.
+	namespaceReader client.Reader
+	// routed is shared between all reconcilers. It is nil if the routing state is disabled.
+	routed *routedOrganizations
+	// shard is nil if sharding is disabled.
+	shard shard
+	// resync is used to enqueue objects without them having changed.
+	resync chan event.GenericEvent
+	// failures holds the objects that could not be sent to the backend.
+	failures *failedUpserts
+}
+
+// reconcilerSettings are the settings of a reconciler that can be changed without restarting it.
+type reconcilerSettings struct {
+	routes       resourceRoutes
+	requeueAfter time.Duration
+}
+
+// currentSettings returns the settings that are currently applied to the reconciler.
+func (r *reconciler) currentSettings() reconcilerSettings {
+	r.settingsLock.Lock()
+	defer r.settingsLock.Unlock()
+	return r.settings
+}
+
+// updateSettings replaces the settings of the reconciler. Objects that are being reconciled keep
+// the settings they started with.
+func (r *reconciler) updateSettings(settings reconcilerSettings) {
+	r.settingsLock.Lock()
+	defer r.settingsLock.Unlock()
+	r.settings = settings
 }
 
 type resourceRoutes struct {
-	clusterResources []string
-	namespaceRoutes  map[string][]string
+	clusterResources []target
+	namespaceRoutes  []namespaceRoute
+	// namespaces is used to read the labels and annotations of namespaces for routes that need
+	// them.
+	namespaces client.Reader
 }
 
-func newResourceRoutes(routes []config.Route) resourceRoutes {
-	cfg := resourceRoutes{
-		clusterResources: []string{},
-		namespaceRoutes:  map[string][]string{},
-	}
+// target is an organization that an object is routed to.
+type target struct {
+	orgID string
+	// pathsToRemove are removed from the object before it is sent to the organization, in addition
+	// to the ones of the scan type.
+	pathsToRemove []string
+}
 
-	// Creating clusterResources with unique organizationIDs
-	// This de-duplicates possible misconfiguration with multiple ClusterScopedResources:true defined for same org
-	clusterRouteSet := map[string]bool{}
-	for _, route := range routes {
-		if route.ClusterScopedResources {
-			clusterRouteSet[route.OrganizationID] = true
+// addTarget adds the given organization to the targets. If it is already a target, the paths to
+// remove are merged, so that attributes removed by any of the routes of an organization are never
+// sent to it.
+func addTarget(targets []target, orgID string, pathsToRemove []string) []target {
+	for i := range targets {
+		if targets[i].orgID == orgID {
+			targets[i].pathsToRemove = appendUnique(targets[i].pathsToRemove, pathsToRemove...)
+			return targets
 		}
 	}
-	for orgID := range clusterRouteSet {
-		cfg.clusterResources = append(cfg.clusterResources, orgID)
+	return append(targets, target{orgID: orgID, pathsToRemove: slices.Clone(pathsToRemove)})
+}
+
+type namespaceRoute struct {
+	orgID         string
+	pathsToRemove []string
+	namespaces    *config.NamespaceMatcher
+	// selector is nil if the route does not select namespaces by their labels.
+	selector labels.Selector
+	// annotation is set if the organization is read from this annotation of the namespace, in
+	// which case the organization needs to be one of the allowed ones, if any.
+	annotation string
+	allowed    []string
+}
+
+// newResourceRoutes returns the routes of resources of the given type. Routes that are restricted to
+// other types are skipped, as are all restricted routes if the resource of the type is not known.
+func newResourceRoutes(routes []config.Route, resource schema.GroupResource, namespaces client.Reader) resourceRoutes {
+	cfg := resourceRoutes{
+		clusterResources: []target{},
+		namespaces:       namespaces,
 	}
 
-	// Set with unique organizationIDs -> orgId -> namespace -> bool
-	namespaceRouteSet := map[string]map[string]bool{}
 	for _, route := range routes {
-		if namespaceRouteSet[route.OrganizationID] == nil {
-			namespaceRouteSet[route.OrganizationID] = map[string]bool{}
+		if len(route.Types) > 0 && (resource.Resource == "" || !route.MatchesType(resource)) {
+			continue
 		}
-		for _, ns := range route.Namespaces {
-			namespaceRouteSet[route.OrganizationID][ns] = true
+
+		// This de-duplicates possible misconfiguration with multiple ClusterScopedResources:true
+		// defined for same org
+		if route.ClusterScopedResources {
+			cfg.clusterResources = addTarget(cfg.clusterResources, route.OrganizationID, route.PathsToRemove)
 		}
-	}
-	// If there is a wildcard namespace route for an organization, do not store other namespace routes.
-	// This helps to de-duplicate if an organization was configured with ["*", "ns-1", ....]
-	for orgID, namespaceRoutes := range namespaceRouteSet {
-		if namespaceRoutes["*"] {
-			cfg.namespaceRoutes["*"] = append(cfg.namespaceRoutes["*"], orgID)
-		} else {
-			for ns := range namespaceRoutes {
-				cfg.namespaceRoutes[ns] = append(cfg.namespaceRoutes[ns], orgID)
-			}
+
+		// the namespaces and selectors have been validated when reading the config.
+		matcher, err := route.NamespaceMatcher()
+		if err != nil {
+			continue
+		}
+		selector, err := route.Selector()
+		if err != nil {
+			continue
 		}
+
+		cfg.namespaceRoutes = append(cfg.namespaceRoutes, namespaceRoute{
+			orgID:         route.OrganizationID,
+			pathsToRemove: route.PathsToRemove,
+			namespaces:    matcher,
+			selector:      selector,
+			annotation:    route.OrganizationIDAnnotation,
+			allowed:       route.AllowedOrganizationIDs,
+		})
 	}
 	return cfg
 }
 
 // targetOrganizations returns target organizations for given request based on config.Routes
 // Resources can be configured to be routed for zero or more organizations
-func (r resourceRoutes) targetOrganizations(req ctrl.Request) []string {
+func (r resourceRoutes) targetOrganizations(ctx context.Context, req ctrl.Request) ([]string, error) {
+	targets, err := r.targets(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	orgs := make([]string, len(targets))
+	for i, t := range targets {
+		orgs[i] = t.orgID
+	}
+	return orgs, nil
+}
+
+// targets returns the organizations that the given request is routed to, along with the attributes
+// that need to be removed for each of them.
+func (r resourceRoutes) targets(ctx context.Context, req ctrl.Request) ([]target, error) {
 	if req.Namespace == "" {
-		return r.clusterResources
+		return r.clusterResources, nil
+	}
+
+	// the namespace is only read once a route needs it.
+	var ns *metav1.PartialObjectMetadata
+	getNamespace := func() (*metav1.PartialObjectMetadata, error) {
+		if ns != nil || r.namespaces == nil {
+			return ns, nil
+		}
+
+		obj := newNamespaceObject()
+		if err := r.namespaces.Get(ctx, client.ObjectKey{Name: req.Namespace}, obj); err != nil {
+			if kerrors.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("could not get namespace %v: %w", req.Namespace, err)
+		}
+		ns = obj
+		return ns, nil
+	}
+
+	// For namespaced resource, return all organizations with routes matching this namespace.
+	targets := []target{}
+	for _, route := range r.namespaceRoutes {
+		orgID, err := route.targetOrganization(ctx, req.Namespace, getNamespace)
+		if err != nil {
+			return nil, err
+		}
+		if orgID != "" {
+			targets = addTarget(targets, orgID, route.pathsToRemove)
+		}
+	}
+	return targets, nil
+}
+
+// targetOrganization returns the organization that the given namespace is routed to by this route.
+// Returns an empty string if the namespace is not routed.
+func (route namespaceRoute) targetOrganization(ctx context.Context, namespace string,
+	getNamespace func() (*metav1.PartialObjectMetadata, error)) (string, error) {
+	if route.namespaces.Excludes(namespace) {
+		return "", nil
+	}
+	if route.annotation == "" && route.namespaces.Matches(namespace) {
+		return route.orgID, nil
+	}
+	if route.annotation == "" && route.selector == nil {
+		return "", nil
+	}
+
+	ns, err := getNamespace()
+	if err != nil || ns == nil {
+		return "", err
+	}
+
+	if route.selector != nil {
+		if route.selector.Matches(labels.Set(ns.GetLabels())) {
+			return route.orgID, nil
+		}
+		return "", nil
+	}
+
+	orgID := ns.GetAnnotations()[route.annotation]
+	if orgID != "" && len(route.allowed) > 0 && !slices.Contains(route.allowed, orgID) {
+		log.FromContext(ctx).Info("skipping organization from namespace annotation as it is not allowed",
+			"annotation", route.annotation, "organization_id", orgID)
+		return "", nil
 	}
-	// For namespaced resource, return all organizations with * and this specific namespace routes
-	return append(r.namespaceRoutes[req.Namespace], r.namespaceRoutes["*"]...)
+	return orgID, nil
 }
 
 type Store interface {
@@ -163,16 +621,25 @@ type Store interface {
 	// be recorded. Otherwise, the store should simply ensure that the object saved in the store
 	// matches the one we're providing.
 	Upsert(ctx context.Context, requestID string, orgID string, resources []backend.Resource) error
+	// List all resources of the organization that are known to the store, including the ones of
+	// other clusters.
+	List(ctx context.Context, orgID string) ([]backend.ResponseData, error)
 }
 
-func newUpsertBatcher(cfg *config.Config, logger logr.Logger, store Store) *batcher.Batcher[string, backend.Resource] {
-	retries := retry.Seconds(3, 5, 10, 15, 30)
-	return batcher.NewBatcher(batcher.Config[string, backend.Resource]{
+func newUpsertBatcher(cfg *config.Config, logger logr.Logger, store Store, sent *sentResources, spool *spooler) *batcher.Batcher[string, upsert] {
+	retries := retry.Exponential{
+		Initial:        3 * time.Second,
+		Max:            30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxElapsedTime: 2 * time.Minute,
+	}
+	return batcher.NewBatcher(batcher.Config[string, upsert]{
 		MaxBatchSize: cfg.Egress.Batching.MaxSize,
 		Interval:     cfg.Egress.Batching.Interval.Duration,
-		Process: func(ctx context.Context, orgID string, resources []backend.Resource) {
+		Process: func(ctx context.Context, orgID string, upserts []upsert) error {
 			requestID := uuid.New().String()
-			reqLogger := logger.WithValues("organization_id", orgID, "request_id", requestID, "batch_size", len(resources))
+			reqLogger := logger.WithValues("organization_id", orgID, "request_id", requestID, "batch_size", len(upserts))
 			logError := func(err error) {
 				if err != nil {
 					var httpErr *backend.HTTPError
@@ -186,12 +653,64 @@ func newUpsertBatcher(cfg *config.Config, logger logr.Logger, store Store) *batc
 					errLogger.Error(fmt.Errorf("could not upsert to store: %w", err), "backend error")
 				}
 			}
-			logError(retry.Retry(reqLogger, retries, func() error {
+
+			// only the upserts that are still pending are sent again, so that resources that have
+			// been sent or are too large to be sent are not sent twice.
+			pending := upserts
+			var sentUpserts, oversizedUpserts []upsert
+			// requests that the backend rejected fail the same way when they are retried.
+			err := retry.Do(ctx, reqLogger, retries, backend.Retryable, func() error {
 				reqLogger.Info("upserting batch")
-				err := store.Upsert(ctx, requestID, orgID, resources)
+				err := store.Upsert(ctx, requestID, orgID, resourcesOf(pending))
 				logError(err)
+
+				var partial *backend.PartialError
+				var oversized *backend.OversizedError
+				switch {
+				case err == nil:
+					sentUpserts, pending = append(sentUpserts, pending...), nil
+				case errors.As(err, &partial):
+					var sent, tooLarge []upsert
+					sent, pending = partitionUpserts(pending, partial.Sent)
+					tooLarge, pending = partitionUpserts(pending, partial.Oversized)
+					sentUpserts, oversizedUpserts = append(sentUpserts, sent...), append(oversizedUpserts, tooLarge...)
+				case errors.As(err, &oversized):
+					// all other resources of the batch have been sent.
+					oversizedUpserts, pending = partitionUpserts(pending, oversized.Resources)
+					sentUpserts, pending = append(sentUpserts, pending...), nil
+				}
 				return err
-			}))
+			})
+
+			sent.record(orgID, sentUpserts)
+			spool.record(orgID, resourcesOf(sentUpserts))
+			// resources that are too large have been reported by the backend. They are not sent
+			// again until they change, as they would only be rejected again.
+			sent.record(orgID, oversizedUpserts)
+			if len(pending) == 0 {
+				return nil
+			}
+
+			if backend.Retryable(err) && spool != nil {
+				// the batch is sent again once the backend recovers, so its objects must not be
+				// reconciled again, which would send them twice.
+				pushErr := spool.push(orgID, resourcesOf(pending))
+				if pushErr == nil {
+					return nil
+				}
+				reqLogger.Error(pushErr, "could not spool batch, reconciling its resources again")
+			}
+			return newFailedUpsertsError(pending, fmt.Errorf("could not upsert batch %v: %w", requestID, err))
+		},
+		Done: func(_ string, u upsert, err error) {
+			// only the upserts that are still pending failed, all others have been handled.
+			var failed *failedUpsertsError
+			if errors.As(err, &failed) && !failed.failed[u.ManifestBlob] {
+				err = nil
+			}
+			if u.done != nil {
+				u.done(err)
+			}
 		},
 	})
 }
@@ -207,13 +726,75 @@ func (r *reconciler) newObject(req ctrl.Request) *unstructured.Unstructured {
 	return obj
 }
 
+// newCacheObject returns an empty object of the type that is cached for this reconciler. Only the
+// metadata of objects is cached if the reconciler is set to be metadata-only.
+func (r *reconciler) newCacheObject() client.Object {
+	if r.metadataOnly {
+		obj := &metav1.PartialObjectMetadata{}
+		obj.SetGroupVersionKind(r.gvk.GroupVersionKind)
+		return obj
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(r.gvk.GroupVersionKind)
+	return obj
+}
+
+// newCacheList returns an empty list of the type that is cached for this reconciler.
+func (r *reconciler) newCacheList() client.ObjectList {
+	gvk := r.gvk.GroupVersion().WithKind(r.gvk.Kind + "List")
+	if r.metadataOnly {
+		list := &metav1.PartialObjectMetadataList{}
+		list.SetGroupVersionKind(gvk)
+		return list
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk)
+	return list
+}
+
 // isIgnored returns true if the given request should be ignored / skipped due to the namespace of
 // the request and the setup of this reconciler.
 func (r *reconciler) isIgnored(req ctrl.Request) bool {
 	// as long as r.namespaces is set, we want to check it. It might be 0-length, which will skip
 	// all namespaced resources. This is expected behavior.
-	return req.Namespace != "" && r.namespaces != nil &&
-		!slices.Contains(r.namespaces, req.Namespace)
+	if req.Namespace != "" && r.namespaces != nil && !r.namespaces.Matches(req.Namespace) {
+		return true
+	}
+
+	// objects in namespaces that are not cached can't be watched, and might not be accessible.
+	if req.Namespace != "" && r.cached != nil && !slices.Contains(r.cached, req.Namespace) {
+		return true
+	}
+
+	// when sharding, another replica is responsible for namespaces we don't own.
+	return r.shard != nil && !r.shard.Owns(req.Namespace)
+}
+
+// enqueueAll enqueues all objects of this reconciler's GVK from the cache that are not ignored.
+func (r *reconciler) enqueueAll(ctx context.Context, opts ...client.ListOption) error {
+	list := r.newCacheList()
+	if err := r.cache.List(ctx, list, opts...); err != nil {
+		return fmt.Errorf("could not list objects: %w", err)
+	}
+
+	return meta.EachListItem(list, func(o runtime.Object) error {
+		obj, ok := o.(client.Object)
+		if !ok {
+			return fmt.Errorf("unexpected list item %T", o)
+		}
+		if r.isIgnored(ctrl.Request{NamespacedName: client.ObjectKeyFromObject(obj)}) {
+			return nil
+		}
+
+		select {
+		case r.resync <- event.GenericEvent{Object: obj}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
 }
 
 func (r *reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -228,15 +809,38 @@ func (r *reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 	)
 	logger.Info("reconciling resource")
 
+	// the tombstone and the failure are removed right away, so that they are not kept around for
+	// ignored objects.
+	tombstone := r.tombstones.pop(req.NamespacedName)
+	failure := r.failures.pop(req.NamespacedName)
+	settings := r.currentSettings()
+
 	if r.isIgnored(req) {
 		logger.Info("skipping resources as namespace is ignored")
+		r.sent.retain(r.gvk.GroupVersionKind, req.NamespacedName, nil)
+		r.failures.forget(req.NamespacedName)
 		// Ignored resource means we don't need to requeue it either.
 		return ctrl.Result{}, nil
 	}
 
-	orgs := r.routes.targetOrganizations(req)
-	if len(orgs) == 0 {
+	targets, err := settings.routes.targets(ctx, req)
+	if err != nil {
+		if tombstone != nil {
+			r.tombstones.add(tombstone)
+		}
+		logger.Error(err, "failed reconciliation")
+		return ctrl.Result{}, err
+	}
+	orgs := make([]string, len(targets))
+	for i, t := range targets {
+		orgs[i] = t.orgID
+	}
+	// objects that are not routed to an organization anymore need to be sent again once they are.
+	r.sent.retain(r.gvk.GroupVersionKind, req.NamespacedName, orgs)
+	// objects that have been routed before need to be deleted from their previous organizations.
+	if len(targets) == 0 && !r.routed.has(r.gvk.GroupVersionKind, req.NamespacedName) {
 		logger.Info("skipping resources as namespace has no routes")
+		r.failures.forget(req.NamespacedName)
 		return ctrl.Result{}, nil
 	}
 
@@ -247,28 +851,119 @@ func (r *reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 	case kerrors.IsNotFound(err):
 		logger = logger.WithValues("reconciliation_action", "delete")
 		deleted = &metav1.Time{Time: time.Now()}
+		// send the last known state of the object if we have it, the backend only needs the
+		// identifying fields otherwise.
+		if tombstone != nil {
+			obj = tombstone
+			// objects of metadata-only informers might not contain their GVK.
+			obj.SetGroupVersionKind(r.gvk.GroupVersionKind)
+		}
 
 	case err != nil:
+		if tombstone != nil {
+			// keep the tombstone for the retry.
+			r.tombstones.add(tombstone)
+		}
 		logger.Error(fmt.Errorf("could not get object from api server: %w", err), "failed reconciliation")
 		return ctrl.Result{}, fmt.Errorf("could not get referenced object %v: %w", req.NamespacedName, err)
 
+	case !matchesSelectors(obj, r.labelSelector, r.fieldSelector):
+		r.failures.forget(req.NamespacedName)
+		// objects that have been sent before need to be deleted once they stop matching.
+		if n := r.deleteExcluded(req, orgs, scannedAt); n > 0 {
+			logger.Info("deleting resource as it does not match the selectors", "organizations", n)
+		} else {
+			logger.Info("skipping resource as it does not match the selectors")
+		}
+		return ctrl.Result{}, nil
+
 	default:
 		logger = logger.WithValues("uid", obj.GetUID(), "reconciliation_action", "upsert")
 	}
 
-	for _, orgID := range orgs {
+	optedOut, err := r.isOptedOut(ctx, obj)
+	if err != nil {
+		if tombstone != nil {
+			r.tombstones.add(tombstone)
+		}
+		logger.Error(err, "failed reconciliation")
+		return ctrl.Result{}, err
+	}
+	if optedOut {
+		r.failures.forget(req.NamespacedName)
+		// objects that have been sent before opting out need to be deleted.
+		if n := r.deleteExcluded(req, orgs, scannedAt); n > 0 {
+			logger.Info("deleting resource as it opted out of scanning", "organizations", n)
+		} else {
+			logger.Info("skipping resource as it opted out of scanning")
+		}
+		if deleted != nil {
+			r.sent.retain(r.gvk.GroupVersionKind, req.NamespacedName, nil)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{RequeueAfter: settings.requeueAfter}, nil
+	}
+
+	// objects whose batch failed are sent again when they are requeued by the controller.
+	if failure != nil {
+		if tombstone != nil {
+			r.tombstones.add(tombstone)
+		}
+		logger.Error(failure, "failed reconciliation")
+		return ctrl.Result{}, failure
+	}
+
+	// the attributes of the scan type are removed for all organizations.
+	r.removeConfiguredAttributes(ctx, obj)
+
+	// the routing might have changed since the object has last been reconciled, e.g. because the
+	// labels or annotations of its namespace changed.
+	for _, orgID := range r.routed.stale(r.gvk.GroupVersionKind, req.NamespacedName, orgs) {
+		reqLogger := logger.WithValues("organization_id", orgID, "request_id", uuid.New().String())
+		reqLogger.Info("deleting resource from organization it is not routed to anymore")
+
+		// the attributes that the organization must not receive are not known anymore, so only the
+		// identifying fields are sent.
+		r.queueDeletion(orgID, r.newObject(req), scannedAt)
+	}
+
+	for _, t := range targets {
 		requestID := uuid.New().String()
-		reqLogger := logger.WithValues("organization_id", orgID, "request_id", requestID)
-		ctx = log.IntoContext(ctx, reqLogger)
+		reqLogger := logger.WithValues("organization_id", t.orgID, "request_id", requestID)
 
-		r.removeConfiguredAttributes(ctx, obj)
-		resource := backend.Resource{
-			ManifestBlob:     obj,
-			PreferredVersion: r.gvk.PreferredVersion,
-			ScannedAt:        scannedAt,
-			DeletedAt:        deleted,
+		// the object is shared between all organizations, so it must not be modified for a single
+		// one of them.
+		orgObj := obj
+		if len(t.pathsToRemove) > 0 {
+			reqLogger.Info("removing resource attributes of route")
+			orgObj = obj.DeepCopy()
+			for _, pathToRemove := range t.pathsToRemove {
+				kubeobjects.RemoveAttributes(orgObj, pathToRemove)
+			}
+		}
+
+		u := upsert{
+			Resource: backend.Resource{
+				ManifestBlob:     orgObj,
+				PreferredVersion: r.gvk.PreferredVersion,
+				ScannedAt:        scannedAt,
+				DeletedAt:        deleted,
+			},
 		}
-		r.upsertBatcher.Queue(orgID, resource)
+		if deleted == nil && r.sent != nil {
+			hash, err := hashObject(orgObj)
+			if err != nil {
+				// the resource is simply sent in this case.
+				reqLogger.Error(err, "could not hash resource")
+			} else if r.sent.unchanged(t.orgID, orgObj, hash) {
+				reqLogger.Info("skipping resource as it did not change since it was last sent")
+				skippedUnchangedTotal.Inc()
+				continue
+			}
+			u.hash = hash
+		}
+		u.done = r.upsertDone(ctx, req, t.orgID, deleted != nil)
+		r.upsertBatcher.Queue(t.orgID, u)
 	}
 
 	logger.Info("successful reconciliation")
@@ -277,7 +972,54 @@ func (r *reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		return ctrl.Result{}, nil
 	}
 
-	return ctrl.Result{RequeueAfter: r.requeueAfter}, nil
+	return ctrl.Result{RequeueAfter: settings.requeueAfter}, nil
+}
+
+// queueDeletion queues the deletion of the given object from the given organization.
+func (r *reconciler) queueDeletion(orgID string, obj *unstructured.Unstructured, deletedAt metav1.Time) {
+	r.upsertBatcher.Queue(orgID, r.newDeletion(orgID, obj, deletedAt))
+}
+
+// newDeletion returns the deletion of the given object from the given organization. The object is
+// not routed to the organization anymore once the deletion has been sent.
+func (r *reconciler) newDeletion(orgID string, obj *unstructured.Unstructured, deletedAt metav1.Time) upsert {
+	return upsert{
+		Resource: backend.Resource{
+			ManifestBlob:     obj,
+			PreferredVersion: r.gvk.PreferredVersion,
+			ScannedAt:        deletedAt,
+			DeletedAt:        &deletedAt,
+		},
+		done: func(err error) {
+			if err == nil {
+				r.routed.remove(r.gvk.GroupVersionKind, client.ObjectKeyFromObject(obj), orgID)
+			}
+		},
+	}
+}
+
+// deleteExcluded deletes the object of the given request, which is excluded from scanning, from the
+// given organizations that it is routed to, and from all organizations that it has been routed to
+// before. As the object might have been sent before the scanner was restarted, the deletion is sent
+// regardless of whether the object is known to have been sent, but only once as long as unchanged
+// resources are skipped. Only the identifying fields are sent, as the object must not be reported
+// anymore. Returns the number of organizations that the deletion is sent to.
+func (r *reconciler) deleteExcluded(req ctrl.Request, orgs []string, deletedAt metav1.Time) int {
+	orgs = appendUnique(slices.Clone(orgs), r.routed.stale(r.gvk.GroupVersionKind, req.NamespacedName, orgs)...)
+
+	obj := r.newObject(req)
+	var n int
+	for _, orgID := range orgs {
+		if r.sent.unchanged(orgID, obj, excludedHash) {
+			skippedUnchangedTotal.Inc()
+			continue
+		}
+		u := r.newDeletion(orgID, obj, deletedAt)
+		u.hash = excludedHash
+		r.upsertBatcher.Queue(orgID, u)
+		n++
+	}
+	return n
 }
 
 func (r *reconciler) removeConfiguredAttributes(ctx context.Context, obj *unstructured.Unstructured) {
@@ -293,12 +1035,22 @@ func (r *reconciler) removeConfiguredAttributes(ctx context.Context, obj *unstru
 	}
 }
 
-// SetupWithManager sets up the controller with the Manager.
-func (r *reconciler) SetupWithManager(mgr ctrl.Manager) error {
-	o := &unstructured.Unstructured{}
-	o.SetGroupVersionKind(r.gvk.GroupVersionKind)
+// SetupWithManager creates an unmanaged controller for the reconciler. The controller is not added to
+// the manager, as it needs to be stopped once the GVK is not available anymore; the caller is
+// responsible for starting it.
+func (r *reconciler) SetupWithManager(mgr ctrl.Manager, name string) (controller.Controller, error) {
+	o := r.newCacheObject()
 
-	return ctrl.NewControllerManagedBy(mgr).
-		For(o).
-		Complete(r)
+	c, err := controller.NewUnmanaged(name, mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return nil, fmt.Errorf("could not create controller: %w", err)
+	}
+	h := recordTombstones{EventHandler: &handler.EnqueueRequestForObject{}, tombstones: r.tombstones}
+	if err := c.Watch(source.Kind(stoppableCache{Cache: mgr.GetCache()}, o), h, r.predicates...); err != nil {
+		return nil, fmt.Errorf("could not watch objects: %w", err)
+	}
+	if err := c.Watch(&source.Channel{Source: r.resync}, &handler.EnqueueRequestForObject{}); err != nil {
+		return nil, fmt.Errorf("could not watch resync channel: %w", err)
+	}
+	return c, nil
 }
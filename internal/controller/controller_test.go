@@ -22,18 +22,23 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/snyk/kubernetes-scanner/internal/backend"
+	"github.com/snyk/kubernetes-scanner/internal/batcher"
 	"github.com/snyk/kubernetes-scanner/internal/config"
 	controllertest "github.com/snyk/kubernetes-scanner/internal/test"
 )
@@ -69,6 +74,8 @@ func TestController(t *testing.T) {
 		Scanning: config.Scan{
 			Types:        test.types,
 			RequeueAfter: metav1.Duration{Duration: time.Second},
+			// the detection runs on startup, which is all we need for this test.
+			DeletionDetectionInterval: metav1.Duration{Duration: time.Hour},
 		},
 		Routes: []config.Route{
 			{OrganizationID: orgRouteAll, ClusterScopedResources: true, Namespaces: []string{"*", "test"}},
@@ -129,6 +136,31 @@ func TestController(t *testing.T) {
 	}()
 
 	fb := newFakeBackend()
+	// this pod was deleted while the scanner wasn't running, the deletion should be detected.
+	deletedPod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "deleted-pod", Namespace: "default"},
+	}
+	fb.resources[orgRouteAll] = []backend.ResponseData{{
+		Attributes: &backend.ResponseAttributes{
+			ClusterName: cfg.ClusterName,
+			ManifestBlob: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata":   map[string]interface{}{"name": "deleted-pod", "namespace": "default"},
+			},
+		},
+	}, {
+		// resources of other clusters must be ignored.
+		Attributes: &backend.ResponseAttributes{
+			ClusterName: "other-cluster",
+			ManifestBlob: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata":   map[string]interface{}{"name": "other-cluster-pod", "namespace": "default"},
+			},
+		},
+	}}
 	backendCtx, backendCancel := context.WithCancel(ctx)
 	go func() {
 		defer backendCancel()
@@ -157,6 +189,15 @@ func TestController(t *testing.T) {
 			t.Errorf("%v", err)
 		}
 	}
+
+	if _, ok := events.deletions[newResourceID(deletedPod, orgRouteAll)]; !ok {
+		t.Errorf("did not detect deletion of %v", deletedPod.Name)
+	}
+	otherClusterPod := deletedPod.DeepCopy()
+	otherClusterPod.Name = "other-cluster-pod"
+	if _, ok := events.deletions[newResourceID(otherClusterPod, orgRouteAll)]; ok {
+		t.Errorf("unexpected deletion of resource of another cluster")
+	}
 }
 
 type test struct {
@@ -295,12 +336,15 @@ type fakeBackend struct {
 	lock            sync.Mutex
 	reconciliations map[resourceIdentifier]int
 	deletions       map[resourceIdentifier]struct{}
+	// resources are returned by List, per organization.
+	resources map[string][]backend.ResponseData
 }
 
 func newFakeBackend() *fakeBackend {
 	return &fakeBackend{
 		reconciliations: map[resourceIdentifier]int{},
 		deletions:       map[resourceIdentifier]struct{}{},
+		resources:       map[string][]backend.ResponseData{},
 	}
 }
 
@@ -322,6 +366,12 @@ func (f *fakeBackend) Upsert(ctx context.Context, requestID string, orgID string
 	return nil
 }
 
+func (f *fakeBackend) List(ctx context.Context, orgID string) ([]backend.ResponseData, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.resources[orgID], nil
+}
+
 func (f *fakeBackend) events() reconciliationEvents {
 	f.lock.Lock()
 	reconciliationEvents := reconciliationEvents{
@@ -471,3 +521,146 @@ func (c testClient) Create(ctx context.Context, obj client.Object, opts ...clien
 
 	return c.Client.Create(ctx, obj, opts...)
 }
+
+// newTestReconciler returns a reconciler for pods that routes all of them to the given
+// organization, along with a function that returns the upserts that have been sent so far. Sent
+// upserts are recorded with the reconciler's sentResources, if any.
+func newTestReconciler(t *testing.T, orgID string, objs ...client.Object) (*reconciler, func() []upsert) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var r *reconciler
+	var lock sync.Mutex
+	var sent []upsert
+	b := batcher.NewBatcher(batcher.Config[string, upsert]{
+		MaxBatchSize: 10,
+		Interval:     10 * time.Millisecond,
+		Process: func(_ context.Context, orgID string, upserts []upsert) error {
+			lock.Lock()
+			defer lock.Unlock()
+			sent = append(sent, upserts...)
+			r.sent.record(orgID, upserts)
+			return nil
+		},
+		Done: func(_ string, u upsert, err error) {
+			if u.done != nil {
+				u.done(err)
+			}
+		},
+	})
+	go func() { _ = b.Start(ctx) }()
+
+	c := fake.NewClientBuilder().WithObjects(objs...).Build()
+	routes := []config.Route{{OrganizationID: orgID, Namespaces: []string{"*"}}}
+	r = &reconciler{
+		Reader: c,
+		cache:  c,
+		settings: reconcilerSettings{
+			routes:       newResourceRoutes(routes, schema.GroupResource{Resource: "pods"}, c),
+			requeueAfter: time.Hour,
+		},
+		gvk:             config.GroupVersionKind{GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "Pod"}},
+		upsertBatcher:   b,
+		tombstones:      newTombstones(),
+		namespaceReader: c,
+		routed:          newRoutedOrganizations(),
+	}
+	return r, func() []upsert {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]upsert(nil), sent...)
+	}
+}
+
+func TestReconcileDeletesExcludedObjects(t *testing.T) {
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "pod"}}
+	optOut := map[string]string{optOutAnnotation: optOutValue}
+	setAnnotations := func(t *testing.T, c client.Client, obj client.Object, annotations map[string]string) {
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(obj), obj))
+		obj.SetAnnotations(annotations)
+		require.NoError(t, c.Update(ctx, obj))
+	}
+
+	for _, tc := range []struct {
+		name string
+		// exclude excludes the pod from scanning, include reverts it.
+		exclude func(t *testing.T, r *reconciler, c client.Client)
+		include func(t *testing.T, r *reconciler, c client.Client)
+	}{
+		{
+			name: "opted out",
+			exclude: func(t *testing.T, r *reconciler, c client.Client) {
+				setAnnotations(t, c, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"}}, optOut)
+			},
+			include: func(t *testing.T, r *reconciler, c client.Client) {
+				setAnnotations(t, c, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"}}, nil)
+			},
+		},
+		{
+			name: "namespace opted out",
+			exclude: func(t *testing.T, r *reconciler, c client.Client) {
+				setAnnotations(t, c, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, optOut)
+			},
+			include: func(t *testing.T, r *reconciler, c client.Client) {
+				setAnnotations(t, c, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, nil)
+			},
+		},
+		{
+			name: "not matching the selectors",
+			exclude: func(t *testing.T, r *reconciler, c client.Client) {
+				r.labelSelector = labels.SelectorFromSet(labels.Set{"team": "payments"})
+			},
+			include: func(t *testing.T, r *reconciler, c client.Client) {
+				r.labelSelector = nil
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newObjects := func() []client.Object {
+				return []client.Object{
+					&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+					&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+						Namespace: "default",
+						Name:      "pod",
+						Labels:    map[string]string{"team": "ledger"},
+					}},
+				}
+			}
+			r, sent := newTestReconciler(t, "org", newObjects()...)
+			r.sent = newSentResources(time.Hour)
+			c := r.Reader.(client.Client)
+			reconcile := func(r *reconciler) {
+				_, err := r.Reconcile(ctx, req)
+				require.NoError(t, err)
+			}
+
+			reconcile(r)
+			require.Eventually(t, func() bool { return len(sent()) == 1 }, time.Second, 10*time.Millisecond)
+			require.Nil(t, sent()[0].DeletedAt)
+
+			tc.exclude(t, r, c)
+			reconcile(r)
+			require.Eventually(t, func() bool { return len(sent()) == 2 }, time.Second, 10*time.Millisecond)
+			reconcile(r)
+			require.Never(t, func() bool { return len(sent()) > 2 }, 100*time.Millisecond, 10*time.Millisecond,
+				"the deletion should only be sent once")
+			require.NotNil(t, sent()[1].DeletedAt)
+			require.Equal(t, r.newObject(req), sent()[1].ManifestBlob, "only the identifying fields should be sent")
+
+			// the object is sent again once it is included, even if it did not change.
+			tc.include(t, r, c)
+			reconcile(r)
+			require.Eventually(t, func() bool { return len(sent()) == 3 }, time.Second, 10*time.Millisecond)
+			require.Nil(t, sent()[2].DeletedAt)
+
+			// the deletion does not depend on the object being known to have been sent, which is not
+			// the case after a restart.
+			restarted, restartedSent := newTestReconciler(t, "org", newObjects()...)
+			tc.exclude(t, restarted, restarted.Reader.(client.Client))
+			reconcile(restarted)
+			require.Eventually(t, func() bool { return len(restartedSent()) == 1 }, time.Second, 10*time.Millisecond)
+			require.NotNil(t, restartedSent()[0].DeletedAt)
+		})
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/slices"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/snyk/kubernetes-scanner/internal/backend"
+)
+
+var deletionsDetectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "kubernetes_scanner",
+	Name:      "deletions_detected_total",
+	Help:      "The number of resources known to the backend that have been found to be deleted from the cluster.",
+})
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(deletionsDetectedTotal)
+}
+
+// deletionDetector finds resources that are known to the backend but do not exist in the cluster
+// anymore, e.g. because they have been deleted while the scanner was not running. These resources
+// are enqueued with their reconciler, which then sends the deletion to the backend. It implements
+// controller-runtime's Runnable interface.
+type deletionDetector struct {
+	store       Store
+	clusterName string
+	rs          *reconcilers
+	interval    time.Duration
+	log         logr.Logger
+}
+
+// Start runs the detection once the reconcilers have been started, and then every interval until
+// the given context is done.
+func (d *deletionDetector) Start(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-d.rs.started:
+	}
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		d.detect(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection ensures that deletions are only detected on the elected leader.
+func (d *deletionDetector) NeedLeaderElection() bool {
+	return true
+}
+
+func (d *deletionDetector) detect(ctx context.Context) {
+	// collect all running reconcilers by their GVK, along with their context.
+	type running struct {
+		ctx context.Context
+		*reconciler
+	}
+	reconcilers := map[schema.GroupVersionKind][]running{}
+	d.rs.each(func(ctx context.Context, r *reconciler) {
+		reconcilers[r.gvk.GroupVersionKind] = append(reconcilers[r.gvk.GroupVersionKind], running{ctx, r})
+	})
+
+	for _, orgID := range d.rs.config().Organizations() {
+		logger := d.log.WithValues("organization_id", orgID)
+		resources, err := d.store.List(ctx, orgID)
+		if err != nil {
+			logger.Error(err, "could not list resources for deletion detection")
+			continue
+		}
+
+		var detected int
+		for _, res := range resources {
+			gvk, req, ok := d.identify(res)
+			if !ok {
+				continue
+			}
+
+			for _, r := range reconcilers[gvk] {
+				enqueued, err := r.enqueueIfDeleted(r.ctx, orgID, req)
+				if err != nil {
+					logger.Error(err, "could not check for deleted resource", "gvk", gvk, "resource", req)
+					continue
+				}
+				if enqueued {
+					detected++
+					break
+				}
+			}
+		}
+
+		deletionsDetectedTotal.Add(float64(detected))
+		logger.Info("finished deletion detection", "resources", len(resources), "deleted", detected)
+	}
+}
+
+// identify returns the GVK & name of the given backend resource. Returns false if the resource
+// belongs to another cluster, has already been deleted, or can't be identified.
+func (d *deletionDetector) identify(res backend.ResponseData) (schema.GroupVersionKind, ctrl.Request, bool) {
+	attrs := res.Attributes
+	if attrs == nil || attrs.ClusterName != d.clusterName || attrs.DeletedAt != "" || attrs.ManifestBlob == nil {
+		return schema.GroupVersionKind{}, ctrl.Request{}, false
+	}
+
+	obj := &unstructured.Unstructured{Object: attrs.ManifestBlob}
+	gvk := obj.GroupVersionKind()
+	if gvk.Kind == "" || obj.GetName() == "" {
+		return schema.GroupVersionKind{}, ctrl.Request{}, false
+	}
+
+	return gvk, ctrl.Request{NamespacedName: types.NamespacedName{
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}}, true
+}
+
+// enqueueIfDeleted enqueues the object of the given request if it is handled by this reconciler
+// for the given organization, but does not exist in the cache anymore. Returns true if the object
+// has been enqueued.
+func (r *reconciler) enqueueIfDeleted(ctx context.Context, orgID string, req ctrl.Request) (bool, error) {
+	if r.isIgnored(req) {
+		return false, nil
+	}
+	orgs, err := r.currentSettings().routes.targetOrganizations(ctx, req)
+	if err != nil {
+		return false, fmt.Errorf("could not get target organizations: %w", err)
+	}
+	if !slices.Contains(orgs, orgID) {
+		return false, nil
+	}
+	return r.enqueueIfMissing(ctx, req)
+}
+
+// enqueueIfMissing enqueues the object of the given request if it does not exist in the cache.
+// Returns true if the object has been enqueued.
+func (r *reconciler) enqueueIfMissing(ctx context.Context, req ctrl.Request) (bool, error) {
+	switch err := r.cache.Get(ctx, req.NamespacedName, r.newCacheObject()); {
+	case err == nil:
+		return false, nil
+	case !kerrors.IsNotFound(err):
+		return false, fmt.Errorf("could not get object from cache: %w", err)
+	}
+
+	select {
+	case r.resync <- event.GenericEvent{Object: r.newObject(req)}:
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// failedUpserts holds the objects whose batch could not be sent to the backend after all retries.
+// They are reconciled again after a backoff that grows with every consecutive failure, and the
+// failure is returned by that reconciliation. This way, the controller requeues them with its
+// rate limiter, and counts the failure as a reconcile error. A nil *failedUpserts ignores failures.
+type failedUpserts struct {
+	lock    sync.Mutex
+	errs    map[types.NamespacedName]error
+	limiter workqueue.RateLimiter
+}
+
+func newFailedUpserts(baseDelay, maxDelay time.Duration) *failedUpserts {
+	return &failedUpserts{
+		errs:    map[types.NamespacedName]error{},
+		limiter: workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay),
+	}
+}
+
+// failed records the failure of an upsert of the given object. Returns the delay after which the
+// object should be reconciled again, and false if a failure is already pending for the object, in
+// which case it is already going to be reconciled again.
+func (f *failedUpserts) failed(key types.NamespacedName, err error) (time.Duration, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.errs[key]; ok {
+		return 0, false
+	}
+	f.errs[key] = err
+	return f.limiter.When(key), true
+}
+
+// succeeded resets the backoff of the given object, unless another upsert of it failed.
+func (f *failedUpserts) succeeded(key types.NamespacedName) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.errs[key]; !ok {
+		f.limiter.Forget(key)
+	}
+}
+
+// pop removes and returns the pending failure of the given object. Returns nil if there is none.
+func (f *failedUpserts) pop(key types.NamespacedName) error {
+	if f == nil {
+		return nil
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	err := f.errs[key]
+	delete(f.errs, key)
+	return err
+}
+
+// forget removes the pending failure and resets the backoff of the given object, e.g. because it
+// is not sent anymore.
+func (f *failedUpserts) forget(key types.NamespacedName) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.errs, key)
+	f.limiter.Forget(key)
+}
+
+// failedUpsertsError is returned when processing a batch if some of its upserts could not be sent.
+type failedUpsertsError struct {
+	// failed holds the manifests of the upserts that could not be sent.
+	failed map[client.Object]bool
+	err    error
+}
+
+func newFailedUpsertsError(upserts []upsert, err error) *failedUpsertsError {
+	failed := make(map[client.Object]bool, len(upserts))
+	for _, u := range upserts {
+		failed[u.ManifestBlob] = true
+	}
+	return &failedUpsertsError{failed: failed, err: err}
+}
+
+func (e *failedUpsertsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *failedUpsertsError) Unwrap() error {
+	return e.err
+}
+
+// upsertDone returns the completion callback for upserts of the object of the given request to the
+// given organization. Once the upsert has been sent, the organization is recorded as routed to, or
+// not routed to anymore if the object has been deleted. If the upsert finally failed, the object is
+// enqueued again after the backoff, unless the given context is done by then.
+func (r *reconciler) upsertDone(ctx context.Context, req ctrl.Request, orgID string, deleted bool) func(error) {
+	return func(err error) {
+		if err == nil {
+			if deleted {
+				r.routed.remove(r.gvk.GroupVersionKind, req.NamespacedName, orgID)
+			} else {
+				r.routed.add(r.gvk.GroupVersionKind, req.NamespacedName, orgID)
+			}
+			r.failures.succeeded(req.NamespacedName)
+			return
+		}
+
+		if r.failures == nil {
+			return
+		}
+
+		delay, ok := r.failures.failed(req.NamespacedName, fmt.Errorf("could not send resource: %w", err))
+		if !ok {
+			return
+		}
+		time.AfterFunc(delay, func() {
+			select {
+			case r.resync <- event.GenericEvent{Object: r.newObject(req)}:
+			case <-ctx.Done():
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/snyk/kubernetes-scanner/internal/backend"
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+func TestFailedUpserts(t *testing.T) {
+	errFailed := errors.New("failed")
+	key := types.NamespacedName{Namespace: "default", Name: "pod"}
+	f := newFailedUpserts(time.Second, time.Minute)
+
+	delay, ok := f.failed(key, errFailed)
+	require.True(t, ok)
+	require.Equal(t, time.Second, delay)
+	_, ok = f.failed(key, errFailed)
+	require.False(t, ok, "the object is already going to be reconciled again")
+
+	require.Equal(t, errFailed, f.pop(key))
+	require.NoError(t, f.pop(key), "failures should only be returned once")
+
+	delay, _ = f.failed(key, errFailed)
+	require.Equal(t, 2*time.Second, delay, "the backoff should grow with consecutive failures")
+
+	f.succeeded(key)
+	require.Equal(t, errFailed, f.pop(key), "failures should be kept until they are returned")
+	f.succeeded(key)
+	delay, _ = f.failed(key, errFailed)
+	require.Equal(t, time.Second, delay, "the backoff should be reset after a success")
+
+	f.forget(key)
+	require.NoError(t, f.pop(key), "forgotten failures should not be returned")
+	delay, _ = f.failed(key, errFailed)
+	require.Equal(t, time.Second, delay, "the backoff should be reset after forgetting the object")
+
+	var nilFailures *failedUpserts
+	require.NoError(t, nilFailures.pop(key))
+	nilFailures.forget(key)
+}
+
+func TestReconcileForgetsFailuresOfIgnoredObjects(t *testing.T) {
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "pod"}}
+
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		setup       func(t *testing.T, r *reconciler)
+	}{
+		{
+			name: "namespace ignored",
+			setup: func(t *testing.T, r *reconciler) {
+				matcher, err := config.ScanType{Namespaces: []string{"other"}}.NamespaceMatcher()
+				require.NoError(t, err)
+				r.namespaces = matcher
+			},
+		},
+		{
+			name: "not routed",
+			setup: func(t *testing.T, r *reconciler) {
+				routes := []config.Route{{OrganizationID: "org", Namespaces: []string{"other"}}}
+				r.settings.routes = newResourceRoutes(routes, schema.GroupResource{Resource: "pods"}, r.cache)
+			},
+		},
+		{
+			name: "not matching the selectors",
+			setup: func(t *testing.T, r *reconciler) {
+				r.labelSelector = labels.SelectorFromSet(labels.Set{"team": "payments"})
+			},
+		},
+		{
+			name:        "opted out",
+			annotations: map[string]string{optOutAnnotation: optOutValue},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        req.Name,
+				Namespace:   req.Namespace,
+				Annotations: tc.annotations,
+			}}
+			r, _ := newTestReconciler(t, "org", pod)
+			r.failures = newFailedUpserts(time.Second, time.Minute)
+			if tc.setup != nil {
+				tc.setup(t, r)
+			}
+			// the object failed twice, and is reconciled again because of the second failure.
+			r.failures.failed(req.NamespacedName, errors.New("failed"))
+			r.failures.pop(req.NamespacedName)
+			r.failures.failed(req.NamespacedName, errors.New("failed"))
+
+			_, err := r.Reconcile(context.Background(), req)
+			require.NoError(t, err, "failures of objects that are not sent anymore should not be returned")
+			require.Empty(t, r.failures.errs)
+			require.Zero(t, r.failures.limiter.NumRequeues(req.NamespacedName), "the backoff should be reset")
+		})
+	}
+}
+
+func TestUpsertDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &reconciler{
+		gvk:      config.GroupVersionKind{GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "Pod"}},
+		resync:   make(chan event.GenericEvent),
+		failures: newFailedUpserts(time.Millisecond, time.Second),
+		routed:   newRoutedOrganizations(),
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "pod"}}
+	done := r.upsertDone(ctx, req, "org", false)
+
+	done(nil)
+	require.NoError(t, r.failures.pop(req.NamespacedName))
+	require.True(t, r.routed.has(r.gvk.GroupVersionKind, req.NamespacedName), "the organization should be recorded once sent")
+
+	r.upsertDone(ctx, req, "org", true)(errors.New("backend unavailable"))
+	require.True(t, r.routed.has(r.gvk.GroupVersionKind, req.NamespacedName), "failed deletions should not be recorded")
+	<-r.resync
+	require.Error(t, r.failures.pop(req.NamespacedName))
+
+	r.upsertDone(ctx, req, "org", true)(nil)
+	require.False(t, r.routed.has(r.gvk.GroupVersionKind, req.NamespacedName), "sent deletions should be recorded")
+
+	done(errors.New("backend unavailable"))
+	select {
+	case e := <-r.resync:
+		require.Equal(t, "pod", e.Object.GetName())
+		require.Equal(t, "default", e.Object.GetNamespace())
+	case <-time.After(time.Second):
+		t.Fatal("the object should be enqueued again")
+	}
+	require.ErrorContains(t, r.failures.pop(req.NamespacedName), "backend unavailable")
+
+	require.False(t, r.routed.has(r.gvk.GroupVersionKind, req.NamespacedName), "failed upserts should not be recorded")
+
+	// failures and routed organizations are ignored without tracking.
+	(&reconciler{}).upsertDone(ctx, req, "org", false)(nil)
+	(&reconciler{}).upsertDone(ctx, req, "org", false)(errors.New("backend unavailable"))
+}
+
+func TestUpsertBatcherReportsFailedUpserts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	scannedAt := metav1.Now()
+	sentRes, oversizedRes, failedRes := newTestResource("sent", scannedAt), newTestResource("oversized", scannedAt),
+		newTestResource("failed", scannedAt)
+	store := &failingStore{fakeBackend: newFakeBackend(), err: &backend.PartialError{
+		Sent:      []backend.Resource{sentRes},
+		Oversized: []backend.Resource{oversizedRes},
+		// the batch is not retried, as the backend rejects it.
+		Err: &backend.HTTPError{StatusCode: http.StatusBadRequest},
+	}}
+	cfg := &config.Config{Egress: &config.Egress{Batching: config.Batching{
+		Interval: metav1.Duration{Duration: 10 * time.Millisecond},
+		MaxSize:  10,
+	}}}
+	sent := newSentResources(time.Hour)
+	b := newUpsertBatcher(cfg, logr.Discard(), store, sent, nil)
+	go func() { _ = b.Start(ctx) }()
+
+	var lock sync.Mutex
+	results := map[string]error{}
+	for _, res := range []backend.Resource{sentRes, oversizedRes, failedRes} {
+		name := res.ManifestBlob.GetName()
+		b.Queue("org", upsert{Resource: res, done: func(err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			results[name] = err
+		}})
+	}
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(results) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, results["sent"])
+	require.NoError(t, results["oversized"], "resources that are too large should not be requeued")
+	require.Error(t, results["failed"])
+	require.True(t, sent.unchanged("org", sentRes.ManifestBlob, [sha256.Size]byte{}))
+	require.True(t, sent.unchanged("org", oversizedRes.ManifestBlob, [sha256.Size]byte{}),
+		"resources that are too large should not be sent again until they change")
+	require.False(t, sent.unchanged("org", failedRes.ManifestBlob, [sha256.Size]byte{}))
+}
@@ -0,0 +1,60 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controller
+
+import (
+	"context"
+
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// stoppableCache wraps a cache and removes the event handlers that are added to its informers once
+// the context they have been requested with is done. controller-runtime's Kind source never
+// removes its event handler, so the handlers of a stopped controller would otherwise keep
+// receiving the events of informers that are shared with other controllers.
+type stoppableCache struct {
+	cache.Cache
+}
+
+func (c stoppableCache) GetInformer(ctx context.Context, obj client.Object, opts ...cache.InformerGetOption) (cache.Informer, error) {
+	i, err := c.Cache.GetInformer(ctx, obj, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &stoppableInformer{Informer: i, ctx: ctx}, nil
+}
+
+// stoppableInformer removes all event handlers that are added to it once its context is done.
+type stoppableInformer struct {
+	cache.Informer
+	ctx context.Context
+}
+
+func (i *stoppableInformer) AddEventHandler(h toolscache.ResourceEventHandler) (toolscache.ResourceEventHandlerRegistration, error) {
+	reg, err := i.Informer.AddEventHandler(h)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-i.ctx.Done()
+		// the informer might have been removed already, in which case there is nothing left to do.
+		_ = i.Informer.RemoveEventHandler(reg)
+	}()
+	return reg, nil
+}
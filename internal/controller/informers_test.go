@@ -0,0 +1,91 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controller
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestStoppableCacheRemovesEventHandlers(t *testing.T) {
+	informer := &fakeInformer{handlers: map[toolscache.ResourceEventHandlerRegistration]bool{}}
+	c := stoppableCache{Cache: &fakeInformerCache{informer: informer}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	i, err := c.GetInformer(ctx, &corev1.Pod{})
+	require.NoError(t, err)
+	_, err = i.AddEventHandler(toolscache.ResourceEventHandlerFuncs{})
+	require.NoError(t, err)
+
+	other, err := c.GetInformer(context.Background(), &corev1.Pod{})
+	require.NoError(t, err)
+	_, err = other.AddEventHandler(toolscache.ResourceEventHandlerFuncs{})
+	require.NoError(t, err)
+	require.Equal(t, 2, informer.len())
+
+	cancel()
+	require.Eventually(t, func() bool { return informer.len() == 1 }, time.Second, 10*time.Millisecond,
+		"the event handler should have been removed once its context is done")
+}
+
+type fakeInformerCache struct {
+	cache.Cache
+	informer *fakeInformer
+}
+
+func (c *fakeInformerCache) GetInformer(context.Context, client.Object, ...cache.InformerGetOption) (cache.Informer, error) {
+	return c.informer, nil
+}
+
+type fakeInformer struct {
+	cache.Informer
+	lock     sync.Mutex
+	handlers map[toolscache.ResourceEventHandlerRegistration]bool
+}
+
+type fakeRegistration struct {
+	toolscache.ResourceEventHandlerRegistration
+}
+
+func (i *fakeInformer) AddEventHandler(toolscache.ResourceEventHandler) (toolscache.ResourceEventHandlerRegistration, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	reg := &fakeRegistration{}
+	i.handlers[reg] = true
+	return reg, nil
+}
+
+func (i *fakeInformer) RemoveEventHandler(reg toolscache.ResourceEventHandlerRegistration) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	delete(i.handlers, reg)
+	return nil
+}
+
+func (i *fakeInformer) len() int {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return len(i.handlers)
+}
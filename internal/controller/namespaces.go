@@ -0,0 +1,115 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"golang.org/x/exp/slices"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+// cacheNamespaces returns the namespaces that need to be cached, which are the ones that are both
+// scanned by any scan type and routed to any organization. Returns nil if all namespaces need to
+// be cached, and an empty slice if no namespace needs to be cached, in which case no namespaced
+// resources can be scanned. Cluster-scoped resources are always cached.
+//
+// If the scanner is restricted to a namespace scope, only namespaces within the scope are cached.
+func cacheNamespaces(cfg *config.Config) []string {
+	var scanned []string
+	var scanAll bool
+	for _, scanType := range cfg.Scanning.Types {
+		// the namespaces have been validated when reading the config.
+		matcher, _ := scanType.NamespaceMatcher()
+		// patterns might match any namespace, and excluded namespaces don't restrict the cache.
+		names, ok := matcher.Names()
+		if !ok {
+			scanAll = true
+			break
+		}
+		scanned = appendUnique(scanned, names...)
+	}
+
+	var routed []string
+	var routeAll bool
+	for _, route := range cfg.Routes {
+		matcher, _ := route.NamespaceMatcher()
+		names, ok := matcher.Names()
+		// namespaces might match the selector or be annotated at any time.
+		if !ok || route.NamespaceSelector != nil || route.OrganizationIDAnnotation != "" {
+			routeAll = true
+			break
+		}
+		routed = appendUnique(routed, names...)
+	}
+
+	namespaces, all := intersect(scanned, scanAll, routed, routeAll)
+	if cfg.NamespaceScope.Enabled {
+		namespaces, all = intersect(namespaces, all, cfg.NamespaceScope.Namespaces, false)
+	}
+
+	if all {
+		return nil
+	}
+	// the namespaces are compared to detect changes on reloads.
+	namespaces = appendUnique([]string{}, namespaces...)
+	slices.Sort(namespaces)
+	return namespaces
+}
+
+// intersect returns the namespaces that are contained in both a and b, where all indicates that a
+// list contains all namespaces.
+func intersect(a []string, aAll bool, b []string, bAll bool) ([]string, bool) {
+	switch {
+	case aAll && bAll:
+		return nil, true
+	case aAll:
+		return slices.Clone(b), false
+	case bAll:
+		return slices.Clone(a), false
+	}
+
+	var namespaces []string
+	for _, ns := range a {
+		if slices.Contains(b, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces, false
+}
+
+// setCacheOptions restricts the cache of the manager to the namespaces that need to be cached. If
+// no namespace needs to be cached, the cache is not restricted, as no namespaced resources are
+// scanned in that case.
+func setCacheOptions(opts *cache.Options, namespaces []string) {
+	if len(namespaces) == 0 {
+		return
+	}
+
+	opts.DefaultNamespaces = map[string]cache.Config{}
+	for _, ns := range namespaces {
+		opts.DefaultNamespaces[ns] = cache.Config{}
+	}
+}
+
+func appendUnique(to []string, values ...string) []string {
+	for _, v := range values {
+		if !slices.Contains(to, v) {
+			to = append(to, v)
+		}
+	}
+	return to
+}
@@ -0,0 +1,131 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+func TestCacheNamespaces(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		scanned    [][]string
+		routed     [][]string
+		scope      []string
+		namespaces []string
+	}{
+		{
+			name:       "all scanned and routed",
+			scanned:    [][]string{nil},
+			routed:     [][]string{{"*"}},
+			namespaces: nil,
+		},
+		{
+			name:       "restricted routes",
+			scanned:    [][]string{nil},
+			routed:     [][]string{{"ns2", "ns1"}, {"ns1", "ns3"}},
+			namespaces: []string{"ns1", "ns2", "ns3"},
+		},
+		{
+			name:       "restricted scan types",
+			scanned:    [][]string{{"ns1"}, {"ns2"}},
+			routed:     [][]string{{"ns3"}, {"*"}},
+			namespaces: []string{"ns1", "ns2"},
+		},
+		{
+			name:       "any scan type with all namespaces",
+			scanned:    [][]string{{"ns1"}, nil},
+			routed:     [][]string{{"ns1", "ns2"}},
+			namespaces: []string{"ns1", "ns2"},
+		},
+		{
+			name:       "intersection",
+			scanned:    [][]string{{"ns1", "ns2"}},
+			routed:     [][]string{{"ns2", "ns3"}},
+			namespaces: []string{"ns2"},
+		},
+		{
+			name:       "empty intersection does not cache any namespace",
+			scanned:    [][]string{{"ns1"}},
+			routed:     [][]string{{"ns2"}},
+			namespaces: []string{},
+		},
+		{
+			name:       "scan type with patterns",
+			scanned:    [][]string{{"ns1"}, {"team-*"}},
+			routed:     [][]string{{"ns1", "ns2"}},
+			namespaces: []string{"ns1", "ns2"},
+		},
+		{
+			name:       "route with patterns",
+			scanned:    [][]string{{"ns1", "ns2"}},
+			routed:     [][]string{{"ns3"}, {"/ns[0-9]+/"}},
+			namespaces: []string{"ns1", "ns2"},
+		},
+		{
+			name:       "only cluster-scoped routes",
+			scanned:    [][]string{nil},
+			routed:     [][]string{nil},
+			namespaces: []string{},
+		},
+		{
+			name:       "namespace scope",
+			scanned:    [][]string{nil},
+			routed:     [][]string{{"*"}},
+			scope:      []string{"ns2", "ns1"},
+			namespaces: []string{"ns1", "ns2"},
+		},
+		{
+			name:       "namespace scope with restricted routes",
+			scanned:    [][]string{nil},
+			routed:     [][]string{{"ns1", "ns3"}},
+			scope:      []string{"ns1", "ns2"},
+			namespaces: []string{"ns1"},
+		},
+		{
+			name:       "namespace scope does not fall back to all namespaces",
+			scanned:    [][]string{{"ns1"}},
+			routed:     [][]string{{"ns3"}},
+			scope:      []string{"ns2"},
+			namespaces: []string{},
+		},
+		{
+			name:       "namespace scope without routes in the scope",
+			scanned:    [][]string{nil},
+			routed:     [][]string{{"ns3"}},
+			scope:      []string{"ns1", "ns2"},
+			namespaces: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			if tc.scope != nil {
+				cfg.NamespaceScope = config.NamespaceScope{Enabled: true, Namespaces: tc.scope}
+			}
+			for _, namespaces := range tc.scanned {
+				cfg.Scanning.Types = append(cfg.Scanning.Types, config.ScanType{Namespaces: namespaces})
+			}
+			for _, namespaces := range tc.routed {
+				cfg.Routes = append(cfg.Routes, config.Route{Namespaces: namespaces})
+			}
+			require.Equal(t, tc.namespaces, cacheNamespaces(cfg))
+		})
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// optOutAnnotation excludes objects from scanning if set to optOutValue, either on the object
+	// itself or on its namespace.
+	optOutAnnotation = "snyk.io/kubernetes-scanner"
+	optOutValue      = "ignore"
+)
+
+var namespaceGVK = schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}
+
+func newNamespaceObject() *metav1.PartialObjectMetadata {
+	ns := &metav1.PartialObjectMetadata{}
+	ns.SetGroupVersionKind(namespaceGVK)
+	return ns
+}
+
+func hasOptOutAnnotation(obj metav1.Object) bool {
+	return obj.GetAnnotations()[optOutAnnotation] == optOutValue
+}
+
+// isOptedOut returns true if the given object or its namespace opted out of scanning.
+func (r *reconciler) isOptedOut(ctx context.Context, obj client.Object) (bool, error) {
+	if hasOptOutAnnotation(obj) {
+		return true, nil
+	}
+
+	if obj.GetNamespace() == "" || r.namespaceReader == nil {
+		return false, nil
+	}
+
+	ns := newNamespaceObject()
+	if err := r.namespaceReader.Get(ctx, client.ObjectKey{Name: obj.GetNamespace()}, ns); err != nil {
+		if kerrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("could not get namespace %v: %w", obj.GetNamespace(), err)
+	}
+	return hasOptOutAnnotation(ns), nil
+}
+
+// namespaceWatcher enqueues all objects of a namespace once its labels or annotations have changed,
+// as these objects would otherwise only be reconciled on their next change. It implements
+// controller-runtime's Runnable interface.
+type namespaceWatcher struct {
+	cache cache.Cache
+	rs    *reconcilers
+	log   logr.Logger
+}
+
+func (w *namespaceWatcher) Start(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-w.rs.started:
+	}
+
+	informer, err := w.cache.GetInformer(ctx, newNamespaceObject())
+	if err != nil {
+		return fmt.Errorf("could not get namespace informer: %w", err)
+	}
+
+	changed := make(chan string, 100)
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNs, ok := oldObj.(metav1.Object)
+			if !ok {
+				return
+			}
+			newNs, ok := newObj.(metav1.Object)
+			if !ok || !namespaceChanged(oldNs, newNs) {
+				return
+			}
+
+			select {
+			case changed <- newNs.GetName():
+			case <-ctx.Done():
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not add namespace event handler: %w", err)
+	}
+
+	for {
+		var namespace string
+		select {
+		case <-ctx.Done():
+			return nil
+		case namespace = <-changed:
+		}
+
+		w.log.Info("namespace changed, enqueueing its objects", "namespace", namespace)
+		w.rs.each(func(ctx context.Context, r *reconciler) {
+			if err := r.enqueueAll(ctx, client.InNamespace(namespace)); err != nil {
+				w.log.Error(err, "could not enqueue objects of namespace", "namespace", namespace, "gvk", r.gvk)
+			}
+		})
+	}
+}
+
+// NeedLeaderElection ensures that the watcher only runs alongside the reconcilers.
+func (w *namespaceWatcher) NeedLeaderElection() bool {
+	return true
+}
+
+// namespaceChanged returns true if the given change of a namespace affects the reconciliation of
+// its objects.
+func namespaceChanged(oldNs, newNs metav1.Object) bool {
+	// besides the opt-out annotation, labels and annotations are used for routing.
+	return !equality.Semantic.DeepEqual(oldNs.GetLabels(), newNs.GetLabels()) ||
+		!equality.Semantic.DeepEqual(oldNs.GetAnnotations(), newNs.GetAnnotations())
+}
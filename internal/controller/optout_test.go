@@ -0,0 +1,104 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestIsOptedOut(t *testing.T) {
+	optOut := map[string]string{optOutAnnotation: optOutValue}
+	c := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "sandbox", Annotations: optOut}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+	).Build()
+	r := &reconciler{namespaceReader: c}
+
+	for _, tc := range []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		expected    bool
+	}{
+		{
+			name:      "not opted out",
+			namespace: "default",
+			expected:  false,
+		},
+		{
+			name:        "object opted out",
+			namespace:   "default",
+			annotations: optOut,
+			expected:    true,
+		},
+		{
+			name:        "other annotation value",
+			namespace:   "default",
+			annotations: map[string]string{optOutAnnotation: "scan"},
+			expected:    false,
+		},
+		{
+			name:      "namespace opted out",
+			namespace: "sandbox",
+			expected:  true,
+		},
+		{
+			name:      "namespace does not exist",
+			namespace: "deleted",
+			expected:  false,
+		},
+		{
+			name:     "cluster-scoped object",
+			expected: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			obj := &unstructured.Unstructured{}
+			obj.SetAPIVersion("v1")
+			obj.SetKind("ConfigMap")
+			obj.SetNamespace(tc.namespace)
+			obj.SetName("config")
+			obj.SetAnnotations(tc.annotations)
+
+			optedOut, err := r.isOptedOut(context.Background(), obj)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, optedOut)
+		})
+	}
+}
+
+func TestNamespaceChanged(t *testing.T) {
+	ns := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "sandbox"}}
+	optedOut := ns.DeepCopy()
+	optedOut.SetAnnotations(map[string]string{optOutAnnotation: optOutValue})
+	labelled := ns.DeepCopy()
+	labelled.SetLabels(map[string]string{"team": "payments"})
+
+	require.True(t, namespaceChanged(ns, optedOut))
+	require.True(t, namespaceChanged(optedOut, ns))
+	require.True(t, namespaceChanged(ns, labelled))
+	annotated := ns.DeepCopy()
+	annotated.SetAnnotations(map[string]string{"snyk.io/org-id": "payments"})
+	require.True(t, namespaceChanged(ns, annotated))
+	require.False(t, namespaceChanged(ns, ns.DeepCopy()))
+}
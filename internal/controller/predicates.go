@@ -0,0 +1,76 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+// newUpdatePredicates returns the predicates for the watch of a reconciler. An update passes if it
+// matches any of the configured update predicates. Without any configured predicates, all events
+// pass.
+func newUpdatePredicates(configured []config.UpdatePredicate) []predicate.Predicate {
+	if len(configured) == 0 {
+		return nil
+	}
+
+	var preds []predicate.Predicate
+	for _, p := range configured {
+		switch p {
+		case config.UpdatePredicateGenerationChanged:
+			preds = append(preds, predicate.GenerationChangedPredicate{})
+		case config.UpdatePredicateLabelsChanged:
+			preds = append(preds, predicate.LabelChangedPredicate{})
+		case config.UpdatePredicateAnnotationsChanged:
+			preds = append(preds, predicate.AnnotationChangedPredicate{})
+		case config.UpdatePredicateIgnoreStatus:
+			preds = append(preds, ignoreStatusPredicate())
+		}
+	}
+	return []predicate.Predicate{predicate.Or(preds...)}
+}
+
+// ignoreStatusPredicate filters updates that only changed the status of an object.
+func ignoreStatusPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldObj, ok := e.ObjectOld.(*unstructured.Unstructured)
+			if !ok {
+				return true
+			}
+			newObj, ok := e.ObjectNew.(*unstructured.Unstructured)
+			if !ok {
+				return true
+			}
+			return !equality.Semantic.DeepEqual(withoutStatus(oldObj), withoutStatus(newObj))
+		},
+	}
+}
+
+// withoutStatus returns a copy of the object without its status and the metadata that changes with
+// every update.
+func withoutStatus(obj *unstructured.Unstructured) map[string]interface{} {
+	obj = obj.DeepCopy()
+	unstructured.RemoveNestedField(obj.Object, "status")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "resourceVersion")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "managedFields")
+	return obj.Object
+}
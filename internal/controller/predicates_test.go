@@ -0,0 +1,119 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+func TestUpdatePredicates(t *testing.T) {
+	newDeployment := func() *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata": map[string]interface{}{
+				"name":            "deployment",
+				"namespace":       "default",
+				"generation":      int64(1),
+				"resourceVersion": "1",
+			},
+			"spec":   map[string]interface{}{"replicas": int64(1)},
+			"status": map[string]interface{}{"readyReplicas": int64(0)},
+		}}
+		return obj
+	}
+
+	for _, tc := range []struct {
+		name       string
+		predicates []config.UpdatePredicate
+		update     func(*unstructured.Unstructured)
+		expected   bool
+	}{
+		{
+			name:       "no predicates",
+			predicates: nil,
+			update: func(obj *unstructured.Unstructured) {
+				obj.Object["status"] = map[string]interface{}{"readyReplicas": int64(1)}
+			},
+			expected: true,
+		},
+		{
+			name:       "ignore status with status update",
+			predicates: []config.UpdatePredicate{config.UpdatePredicateIgnoreStatus},
+			update: func(obj *unstructured.Unstructured) {
+				obj.Object["status"] = map[string]interface{}{"readyReplicas": int64(1)}
+			},
+			expected: false,
+		},
+		{
+			name:       "ignore status with spec update",
+			predicates: []config.UpdatePredicate{config.UpdatePredicateIgnoreStatus},
+			update: func(obj *unstructured.Unstructured) {
+				obj.Object["spec"] = map[string]interface{}{"replicas": int64(2)}
+			},
+			expected: true,
+		},
+		{
+			name:       "generation changed",
+			predicates: []config.UpdatePredicate{config.UpdatePredicateGenerationChanged},
+			update: func(obj *unstructured.Unstructured) {
+				obj.SetGeneration(2)
+			},
+			expected: true,
+		},
+		{
+			name: "label change with generation and labels",
+			predicates: []config.UpdatePredicate{
+				config.UpdatePredicateGenerationChanged,
+				config.UpdatePredicateLabelsChanged,
+			},
+			update: func(obj *unstructured.Unstructured) {
+				obj.SetLabels(map[string]string{"team": "payments"})
+			},
+			expected: true,
+		},
+		{
+			name: "annotation change with generation and labels",
+			predicates: []config.UpdatePredicate{
+				config.UpdatePredicateGenerationChanged,
+				config.UpdatePredicateLabelsChanged,
+			},
+			update: func(obj *unstructured.Unstructured) {
+				obj.SetAnnotations(map[string]string{"foo": "bar"})
+			},
+			expected: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			oldObj := newDeployment()
+			newObj := newDeployment()
+			tc.update(newObj)
+			newObj.SetResourceVersion("2")
+
+			passed := true
+			for _, p := range newUpdatePredicates(tc.predicates) {
+				passed = passed && p.Update(event.UpdateEvent{ObjectOld: oldObj, ObjectNew: newObj})
+			}
+			require.Equal(t, tc.expected, passed)
+		})
+	}
+}
@@ -0,0 +1,288 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+// reconcilerKey identifies a reconciler. As multiple scan types might contain the same GVK (e.g.
+// with different namespaces), the index of the scan type is part of the key.
+type reconcilerKey struct {
+	scanType int
+	gvk      config.GroupVersionKind
+}
+
+func (k reconcilerKey) controllerName() string {
+	name := strings.ToLower(k.gvk.Kind) + "." + k.gvk.Version
+	if k.gvk.Group != "" {
+		name += "." + k.gvk.Group
+	}
+	return fmt.Sprintf("%s-%d", name, k.scanType)
+}
+
+type runningReconciler struct {
+	*reconciler
+	ctx    context.Context
+	cancel context.CancelFunc
+	// scanType is used to detect reconcilers that are outdated after a reload.
+	scanType config.ScanType
+}
+
+// reconcilers manages the reconcilers of all GVKs that should be scanned. GVKs are discovered
+// periodically, so that reconcilers are started for types that have been installed after the
+// scanner started (e.g. through CRDs) and are stopped for types that have been removed. When the
+// config is reloaded, reconcilers of changed scan types are restarted with the new config, while
+// the routes of all other reconcilers are updated in place. It implements controller-runtime's
+// Runnable interface.
+type reconcilers struct {
+	log      logr.Logger
+	interval time.Duration
+	// discover returns all reconcilers that should be running for the given config.
+	discover func(*config.Config) (map[reconcilerKey]config.ScanType, error)
+	// newReconciler creates a new reconciler for the given scan type and GVK.
+	newReconciler func(*config.Config, config.ScanType, config.GroupVersionKind) *reconciler
+	// newSettings returns the settings of a reconciler for the given GVK that can be changed
+	// without restarting it.
+	newSettings func(*config.Config, config.GroupVersionKind) reconcilerSettings
+	// setup creates the controller of the given reconciler, which is started and stopped by the
+	// reconcilers.
+	setup func(r *reconciler, name string) (controller.Controller, error)
+	// informers holds the informers of all reconcilers. Informers that are not needed anymore are
+	// removed from it.
+	informers cache.Informers
+	// transform is updated with the removals of the desired scan types. Might be nil.
+	transform *cacheTransform
+
+	// ready is closed once the reconcilers can be started. Might be nil.
+	ready <-chan struct{}
+	// started is closed once the reconcilers have been started.
+	started chan struct{}
+
+	lock sync.Mutex
+	// ctx is nil until the reconcilers have been started.
+	ctx     context.Context
+	cfg     *config.Config
+	desired map[reconcilerKey]config.ScanType
+	running map[reconcilerKey]*runningReconciler
+}
+
+// Start starts all desired reconcilers once they are ready, and periodically re-runs the discovery
+// until the given context is done. If the interval is zero, the discovery is never re-run.
+func (rs *reconcilers) Start(ctx context.Context) error {
+	if rs.ready != nil {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-rs.ready:
+		}
+	}
+
+	rs.lock.Lock()
+	rs.ctx = ctx
+	rs.sync()
+	rs.lock.Unlock()
+	close(rs.started)
+
+	if rs.interval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(rs.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if err := rs.rediscover(); err != nil {
+			rs.log.Error(err, "could not discover GVKs, keeping current reconcilers")
+		}
+	}
+}
+
+// NeedLeaderElection ensures that reconcilers are only running on the elected leader.
+func (rs *reconcilers) NeedLeaderElection() bool {
+	return true
+}
+
+// config returns the config that is currently applied.
+func (rs *reconcilers) config() *config.Config {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.cfg
+}
+
+// rediscover runs the discovery and updates the running reconcilers accordingly.
+func (rs *reconcilers) rediscover() error {
+	rs.lock.Lock()
+	cfg := rs.cfg
+	rs.lock.Unlock()
+
+	desired, err := rs.discover(cfg)
+	if err != nil {
+		return err
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	// the config might have been reloaded in the meantime, in which case the discovery is outdated.
+	if rs.cfg == cfg {
+		rs.desired = desired
+		rs.sync()
+	}
+	return nil
+}
+
+// reload applies the given config. Reconcilers of scan types that have changed are restarted, so
+// that they don't keep the state of the old scan type. Changed routes are swapped into the running
+// reconcilers instead, which keep their state. If the discovery fails, the current config is kept.
+func (rs *reconcilers) reload(cfg *config.Config) error {
+	desired, err := rs.discover(cfg)
+	if err != nil {
+		return err
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if !reflect.DeepEqual(rs.cfg.Routes, cfg.Routes) || rs.cfg.Scanning.RequeueAfter != cfg.Scanning.RequeueAfter {
+		for key, running := range rs.running {
+			running.updateSettings(rs.newSettings(cfg, key.gvk))
+		}
+	}
+	rs.cfg = cfg
+	rs.desired = desired
+	rs.sync()
+	return nil
+}
+
+// sync stops all reconcilers that are not desired anymore or are outdated, and starts the ones
+// that are not running yet. It does nothing until the reconcilers have been started. rs.lock must
+// be held.
+func (rs *reconcilers) sync() {
+	// the transform needs to be updated before new informers are started.
+	rs.transform.update(rs.desired)
+	if rs.ctx == nil {
+		return
+	}
+
+	for key, running := range rs.running {
+		scanType, ok := rs.desired[key]
+		if ok && reflect.DeepEqual(running.scanType, scanType) {
+			continue
+		}
+		rs.stop(key, running)
+	}
+
+	for key, scanType := range rs.desired {
+		if _, ok := rs.running[key]; ok {
+			continue
+		}
+		if err := rs.start(key, scanType); err != nil {
+			rs.log.Error(err, "could not start reconciler", "gvk", key.gvk)
+		}
+	}
+}
+
+// start starts a new reconciler. rs.lock must be held.
+func (rs *reconcilers) start(key reconcilerKey, scanType config.ScanType) error {
+	r := rs.newReconciler(rs.cfg, scanType, key.gvk)
+	c, err := rs.setup(r, key.controllerName())
+	if err != nil {
+		return fmt.Errorf("unable to create controller for GVK %v: %w", key.gvk, err)
+	}
+
+	ctx, cancel := context.WithCancel(rs.ctx)
+	running := &runningReconciler{
+		reconciler: r,
+		ctx:        ctx,
+		cancel:     cancel,
+		scanType:   scanType,
+	}
+	rs.running[key] = running
+
+	rs.log.Info("starting reconciler", "gvk", key.gvk, "controller", key.controllerName())
+	go func() {
+		if err := c.Start(ctx); err != nil {
+			rs.log.Error(err, "reconciler stopped", "gvk", key.gvk)
+		}
+
+		// if the controller stopped on its own, e.g. because the type was removed before its cache
+		// could sync, remove it so that it can be started again by the next sync.
+		rs.lock.Lock()
+		if rs.running[key] == running {
+			delete(rs.running, key)
+		}
+		rs.lock.Unlock()
+	}()
+
+	return nil
+}
+
+// stop stops a running reconciler and removes its informer, unless the informer is still needed
+// by a desired reconciler. rs.lock must be held.
+func (rs *reconcilers) stop(key reconcilerKey, running *runningReconciler) {
+	rs.log.Info("stopping reconciler", "gvk", key.gvk, "controller", key.controllerName())
+	running.cancel()
+	delete(rs.running, key)
+	// objects of the reconciler need to be sent again if it is started again.
+	running.sent.forgetKind(key.gvk.GroupVersionKind)
+
+	// the metadata-only informer for namespaces is also used to look up namespaces.
+	if running.metadataOnly && key.gvk.GroupVersionKind == namespaceGVK {
+		return
+	}
+
+	// metadata-only reconcilers use a different informer than the others.
+	for other, scanType := range rs.desired {
+		if other.gvk.GroupVersionKind == key.gvk.GroupVersionKind && scanType.MetadataOnly == running.metadataOnly {
+			return
+		}
+	}
+
+	if err := rs.informers.RemoveInformer(rs.ctx, running.newCacheObject()); err != nil {
+		rs.log.Error(err, "could not remove informer", "gvk", key.gvk)
+	}
+}
+
+// each calls the given function for every running reconciler. The context passed to the function
+// is done once the reconciler is stopped.
+func (rs *reconcilers) each(fn func(context.Context, *reconciler)) {
+	rs.lock.Lock()
+	running := make([]*runningReconciler, 0, len(rs.running))
+	for _, r := range rs.running {
+		running = append(running, r)
+	}
+	rs.lock.Unlock()
+
+	for _, r := range running {
+		fn(r.ctx, r.reconciler)
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+func TestControllerName(t *testing.T) {
+	for _, tc := range []struct {
+		key      reconcilerKey
+		expected string
+	}{
+		{
+			key: reconcilerKey{scanType: 0, gvk: config.GroupVersionKind{
+				GroupVersionKind: schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Pod"},
+			}},
+			expected: "pod.v1-0",
+		},
+		{
+			key: reconcilerKey{scanType: 3, gvk: config.GroupVersionKind{
+				GroupVersionKind: schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"},
+			}},
+			expected: "rollout.v1alpha1.argoproj.io-3",
+		},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.key.controllerName())
+		})
+	}
+}
+
+func TestReconcilersSync(t *testing.T) {
+	pods := reconcilerKey{scanType: 0, gvk: config.GroupVersionKind{
+		GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "Pod"},
+	}}
+	rollouts := reconcilerKey{scanType: 1, gvk: config.GroupVersionKind{
+		GroupVersionKind: schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"},
+	}}
+	metadataPods := reconcilerKey{scanType: 2, gvk: pods.gvk}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rs, discovered, controllers, informers := newTestReconcilers(ctx, map[reconcilerKey]config.ScanType{pods: {}})
+	require.ElementsMatch(t, []string{"pod.v1-0"}, controllers.started())
+	pod := rs.running[pods]
+
+	// a CRD has been installed.
+	discovered.set(map[reconcilerKey]config.ScanType{pods: {}, rollouts: {}})
+	require.NoError(t, rs.rediscover())
+	require.ElementsMatch(t, []string{"pod.v1-0", "rollout.v1alpha1.argoproj.io-1"}, controllers.started())
+	require.Same(t, pod, rs.running[pods], "running reconcilers should not be restarted")
+	rollout := rs.running[rollouts]
+	require.NotNil(t, rollout)
+
+	// the CRD has been removed again.
+	discovered.set(map[reconcilerKey]config.ScanType{pods: {}})
+	require.NoError(t, rs.rediscover())
+	require.NotContains(t, rs.running, rollouts)
+	require.Error(t, rollout.ctx.Err(), "the reconciler should have been stopped")
+	require.NoError(t, pod.ctx.Err())
+	require.Equal(t, []schema.GroupVersionKind{rollouts.gvk.GroupVersionKind}, informers.removed())
+
+	// metadata-only reconcilers use a different informer.
+	discovered.set(map[reconcilerKey]config.ScanType{metadataPods: {MetadataOnly: true}})
+	require.NoError(t, rs.rediscover())
+	require.NotContains(t, rs.running, pods)
+	require.Contains(t, rs.running, metadataPods)
+	require.Equal(t, []schema.GroupVersionKind{rollouts.gvk.GroupVersionKind, pods.gvk.GroupVersionKind}, informers.removed(),
+		"the informer of the pods should have been removed")
+
+	// scan types with the same GVK share an informer.
+	otherPods := reconcilerKey{scanType: 3, gvk: pods.gvk}
+	discovered.set(map[reconcilerKey]config.ScanType{metadataPods: {MetadataOnly: true}, pods: {}, otherPods: {}})
+	require.NoError(t, rs.rediscover())
+	discovered.set(map[reconcilerKey]config.ScanType{metadataPods: {MetadataOnly: true}, otherPods: {}})
+	require.NoError(t, rs.rediscover())
+	require.NotContains(t, rs.running, pods)
+	require.Len(t, informers.removed(), 2, "the informer should be kept for the other scan type")
+}
+
+func TestReconcilersReload(t *testing.T) {
+	pods := reconcilerKey{scanType: 0, gvk: config.GroupVersionKind{
+		GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "Pod"},
+	}}
+	deployments := reconcilerKey{scanType: 1, gvk: config.GroupVersionKind{
+		GroupVersionKind: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rs, discovered, _, _ := newTestReconcilers(ctx, map[reconcilerKey]config.ScanType{pods: {}, deployments: {}})
+	pod, deployment := rs.running[pods], rs.running[deployments]
+
+	cfg := &config.Config{}
+	cfg.Scanning.RequeueAfter = metav1.Duration{Duration: time.Hour}
+	discovered.set(map[reconcilerKey]config.ScanType{pods: {}, deployments: {MetadataOnly: true}})
+	require.NoError(t, rs.reload(cfg))
+
+	require.Same(t, pod, rs.running[pods], "reconcilers of unchanged scan types should keep running")
+	require.NoError(t, pod.ctx.Err())
+	require.Equal(t, time.Hour, pod.currentSettings().requeueAfter)
+
+	require.NotSame(t, deployment, rs.running[deployments], "reconcilers of changed scan types should be restarted")
+	require.Error(t, deployment.ctx.Err())
+	require.Equal(t, time.Hour, rs.running[deployments].currentSettings().requeueAfter)
+}
+
+// newTestReconcilers returns started reconcilers whose discovery returns the given reconcilers
+// until the returned discovery is updated.
+func newTestReconcilers(ctx context.Context, desired map[reconcilerKey]config.ScanType) (*reconcilers, *fakeDiscovery, *fakeControllers, *fakeInformers) {
+	discovered := &fakeDiscovery{desired: desired}
+	controllers := &fakeControllers{}
+	informers := &fakeInformers{}
+	newSettings := func(cfg *config.Config, _ config.GroupVersionKind) reconcilerSettings {
+		return reconcilerSettings{requeueAfter: cfg.Scanning.RequeueAfter.Duration}
+	}
+	rs := &reconcilers{
+		log:      logr.Discard(),
+		discover: discovered.discover,
+		newReconciler: func(cfg *config.Config, scanType config.ScanType, gvk config.GroupVersionKind) *reconciler {
+			return &reconciler{gvk: gvk, metadataOnly: scanType.MetadataOnly, settings: newSettings(cfg, gvk)}
+		},
+		newSettings: newSettings,
+		setup:       controllers.setup,
+		informers:   informers,
+		started:     make(chan struct{}),
+		cfg:         &config.Config{},
+		desired:     desired,
+		running:     map[reconcilerKey]*runningReconciler{},
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.ctx = ctx
+	rs.sync()
+	return rs, discovered, controllers, informers
+}
+
+type fakeDiscovery struct {
+	lock    sync.Mutex
+	desired map[reconcilerKey]config.ScanType
+}
+
+func (d *fakeDiscovery) set(desired map[reconcilerKey]config.ScanType) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.desired = desired
+}
+
+func (d *fakeDiscovery) discover(*config.Config) (map[reconcilerKey]config.ScanType, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.desired, nil
+}
+
+// fakeControllers creates controllers that run until their context is done.
+type fakeControllers struct {
+	lock  sync.Mutex
+	names []string
+}
+
+func (c *fakeControllers) setup(_ *reconciler, name string) (controller.Controller, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.names = append(c.names, name)
+	return fakeController{}, nil
+}
+
+func (c *fakeControllers) started() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.names...)
+}
+
+type fakeController struct {
+	controller.Controller
+}
+
+func (fakeController) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+type fakeInformers struct {
+	cache.Informers
+	lock sync.Mutex
+	gvks []schema.GroupVersionKind
+}
+
+func (i *fakeInformers) RemoveInformer(_ context.Context, obj client.Object) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.gvks = append(i.gvks, obj.GetObjectKind().GroupVersionKind())
+	return nil
+}
+
+func (i *fakeInformers) removed() []schema.GroupVersionKind {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return append([]schema.GroupVersionKind(nil), i.gvks...)
+}
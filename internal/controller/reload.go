@@ -0,0 +1,152 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"reflect"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+var (
+	configReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubernetes_scanner",
+		Name:      "config_reloads_total",
+		Help:      "The number of times the config file has been reloaded, by result.",
+	}, []string{"result"})
+	configLastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "kubernetes_scanner",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "The unix timestamp of the last successful config reload.",
+	})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(configReloadsTotal, configLastReload)
+}
+
+// configReloader periodically checks the config file for changes and applies the new config. A
+// config that can't be read or applied is rejected and the current config is kept. It implements
+// controller-runtime's Runnable interface.
+type configReloader struct {
+	cfg      *config.Config
+	interval time.Duration
+	apply    func(*config.Config) error
+	log      logr.Logger
+
+	// checksum of the file contents that have been seen last, whether they've been applied or not.
+	checksum [sha256.Size]byte
+}
+
+func (c *configReloader) Start(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		c.reload()
+	}
+}
+
+// NeedLeaderElection returns false so that standby replicas keep their config up-to-date as well.
+func (c *configReloader) NeedLeaderElection() bool {
+	return false
+}
+
+func (c *configReloader) reload() {
+	checksum, err := config.FileChecksum(c.cfg.Path())
+	if err != nil {
+		c.log.Error(err, "could not check config file for changes")
+		return
+	}
+	if checksum == c.checksum {
+		return
+	}
+
+	c.log.Info("config file changed, reloading", "path", c.cfg.Path())
+	cfg, err := config.Read(c.cfg.Path())
+	if err != nil {
+		// an invalid config is only rejected once, not on every check.
+		c.checksum = checksum
+		configReloadsTotal.WithLabelValues("failure").Inc()
+		c.log.Error(err, "rejecting invalid config, keeping the current one")
+		return
+	}
+
+	// applying the config might fail temporarily, e.g. when the discovery fails. It is retried
+	// with the next check.
+	if err := c.apply(cfg); err != nil {
+		configReloadsTotal.WithLabelValues("failure").Inc()
+		c.log.Error(err, "could not apply config, keeping the current one")
+		return
+	}
+
+	if restartRequired(c.cfg, cfg) {
+		// the selectors and namespaces of the informer cache are fixed for the lifetime of the
+		// manager, so rebuilding it would require restarting all reconcilers anyway.
+		c.log.Info("config contains changes that are only applied after a restart of the scanner")
+	}
+	c.cfg = cfg
+	c.checksum = checksum
+	configReloadsTotal.WithLabelValues("success").Inc()
+	configLastReload.SetToCurrentTime()
+	c.log.Info("config reloaded successfully")
+}
+
+// restartRequired returns true if settings other than the scan types and routes have changed, or
+// if the changed scan types and routes require caching other namespaces.
+func restartRequired(old, new *config.Config) bool {
+	return old.MetricsAddress != new.MetricsAddress ||
+		old.MetricsNamespace != new.MetricsNamespace ||
+		old.ProbeAddress != new.ProbeAddress ||
+		old.ClusterName != new.ClusterName ||
+		old.Scanning.DiscoveryInterval != new.Scanning.DiscoveryInterval ||
+		old.Scanning.ResendUnchangedAfter != new.Scanning.ResendUnchangedAfter ||
+		old.Scanning.DeletionDetectionInterval != new.Scanning.DeletionDetectionInterval ||
+		old.ReloadInterval != new.ReloadInterval ||
+		!reflect.DeepEqual(old.Egress, new.Egress) ||
+		!reflect.DeepEqual(old.Logging, new.Logging) ||
+		!reflect.DeepEqual(old.LeaderElection, new.LeaderElection) ||
+		!reflect.DeepEqual(old.Sharding, new.Sharding) ||
+		!reflect.DeepEqual(old.NamespaceScope, new.NamespaceScope) ||
+		old.RoutingState != new.RoutingState ||
+		// the namespaces and selectors of the cache can only be set when creating the manager.
+		!reflect.DeepEqual(cacheNamespaces(old), cacheNamespaces(new)) ||
+		!reflect.DeepEqual(scanTypeSelectors(old), scanTypeSelectors(new))
+}
+
+// scanTypeSelectors returns the label and field selectors of all scan types that use them.
+func scanTypeSelectors(cfg *config.Config) [][2]string {
+	var selectors [][2]string
+	for _, scanType := range cfg.Scanning.Types {
+		if scanType.LabelSelector != "" || scanType.FieldSelector != "" {
+			selectors = append(selectors, [2]string{scanType.LabelSelector, scanType.FieldSelector})
+		}
+	}
+	return selectors
+}
@@ -0,0 +1,92 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+func TestRestartRequired(t *testing.T) {
+	newConfig := func() *config.Config {
+		return &config.Config{
+			ClusterName: "cluster",
+			Routes:      []config.Route{{OrganizationID: "org", Namespaces: []string{"*"}}},
+			Scanning: config.Scan{
+				Types:        []config.ScanType{{APIGroups: []string{""}, Resources: []string{"pods"}}},
+				RequeueAfter: metav1.Duration{Duration: time.Hour},
+			},
+			Egress: &config.Egress{SnykAPIBaseURL: "https://api.snyk.io"},
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		modify   func(*config.Config)
+		expected bool
+	}{
+		{
+			name:     "unchanged",
+			modify:   func(*config.Config) {},
+			expected: false,
+		},
+		{
+			name: "reloadable settings",
+			modify: func(c *config.Config) {
+				c.Routes = append(c.Routes, config.Route{OrganizationID: "other", ClusterScopedResources: true})
+				c.Scanning.Types[0].Resources = []string{"pods", "services"}
+				c.Scanning.RequeueAfter = metav1.Duration{Duration: time.Minute}
+			},
+			expected: false,
+		},
+		{
+			name:     "cluster name",
+			modify:   func(c *config.Config) { c.ClusterName = "other" },
+			expected: true,
+		},
+		{
+			name:     "egress",
+			modify:   func(c *config.Config) { c.Egress.SnykAPIBaseURL = "https://api.eu.snyk.io" },
+			expected: true,
+		},
+		{
+			name:     "cache namespaces",
+			modify:   func(c *config.Config) { c.Routes[0].Namespaces = []string{"default"} },
+			expected: true,
+		},
+		{
+			name:     "selectors",
+			modify:   func(c *config.Config) { c.Scanning.Types[0].LabelSelector = "team=payments" },
+			expected: true,
+		},
+		{
+			name:     "leader election",
+			modify:   func(c *config.Config) { c.LeaderElection.Enabled = true },
+			expected: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			modified := newConfig()
+			tc.modify(modified)
+			require.Equal(t, tc.expected, restartRequired(newConfig(), modified))
+		})
+	}
+}
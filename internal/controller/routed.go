@@ -0,0 +1,162 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"sync"
+
+	"golang.org/x/exp/slices"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// routedOrganizations tracks the organizations that each object has been sent to, so that objects
+// can be deleted from organizations that they are not routed to anymore, e.g. because the labels or
+// annotations of their namespace changed. Organizations are only recorded once the object has been
+// sent successfully. It is shared between all reconcilers, so that it is kept when reconcilers are
+// restarted. A nil *routedOrganizations does not track anything, which is the case if the routing
+// state is not persisted.
+type routedOrganizations struct {
+	lock    sync.Mutex
+	objects map[routedKey][]string
+	// version is increased on every change, to detect changes that need to be persisted.
+	version uint64
+}
+
+type routedKey struct {
+	gvk schema.GroupVersionKind
+	types.NamespacedName
+}
+
+func newRoutedOrganizations() *routedOrganizations {
+	return &routedOrganizations{objects: map[routedKey][]string{}}
+}
+
+// has returns true if the given object is routed to any organization.
+func (r *routedOrganizations) has(gvk schema.GroupVersionKind, key types.NamespacedName) bool {
+	if r == nil {
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.objects[routedKey{gvk, key}]) > 0
+}
+
+// stale returns the organizations that the given object has been sent to, but that are not part
+// of the given ones anymore.
+func (r *routedOrganizations) stale(gvk schema.GroupVersionKind, key types.NamespacedName, orgs []string) []string {
+	if r == nil {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var stale []string
+	for _, orgID := range r.objects[routedKey{gvk, key}] {
+		if !slices.Contains(orgs, orgID) {
+			stale = append(stale, orgID)
+		}
+	}
+	return stale
+}
+
+// add records that the given object has been sent to the organization.
+func (r *routedOrganizations) add(gvk schema.GroupVersionKind, key types.NamespacedName, orgID string) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	k := routedKey{gvk, key}
+	r.set(k, appendUnique(slices.Clone(r.objects[k]), orgID))
+}
+
+// remove records that the given object has been deleted from the organization. Objects are
+// forgotten once they have been deleted from all organizations.
+func (r *routedOrganizations) remove(gvk schema.GroupVersionKind, key types.NamespacedName, orgID string) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	k := routedKey{gvk, key}
+	var orgs []string
+	for _, o := range r.objects[k] {
+		if o != orgID {
+			orgs = append(orgs, o)
+		}
+	}
+	r.set(k, orgs)
+}
+
+// set records the given organizations for an object, or forgets the object if there are none.
+// r.lock must be held.
+func (r *routedOrganizations) set(k routedKey, orgs []string) {
+	prev, ok := r.objects[k]
+	switch {
+	case len(orgs) == 0 && !ok:
+		return
+	case len(orgs) == 0:
+		delete(r.objects, k)
+	case slices.Equal(prev, orgs):
+		return
+	default:
+		r.objects[k] = slices.Clone(orgs)
+	}
+	r.version++
+}
+
+// keys returns the keys of all objects that are routed to any organization.
+func (r *routedOrganizations) keys() []routedKey {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	keys := make([]routedKey, 0, len(r.objects))
+	for k := range r.objects {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// snapshot returns a copy of all routed objects along with the current version.
+func (r *routedOrganizations) snapshot() (map[routedKey][]string, uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// the slices are never modified, only replaced.
+	objects := make(map[routedKey][]string, len(r.objects))
+	for k, orgs := range r.objects {
+		objects[k] = orgs
+	}
+	return objects, r.version
+}
+
+// restore adds the given routed objects, e.g. after reading them from persistent storage. The
+// organizations of objects that are already known are merged.
+func (r *routedOrganizations) restore(objects map[routedKey][]string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for k, orgs := range objects {
+		r.set(k, appendUnique(slices.Clone(r.objects[k]), orgs...))
+	}
+}
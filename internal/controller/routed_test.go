@@ -0,0 +1,75 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRoutedOrganizations(t *testing.T) {
+	r := newRoutedOrganizations()
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	key := types.NamespacedName{Namespace: "default", Name: "pod"}
+
+	require.False(t, r.has(gvk, key))
+	r.add(gvk, key, "a")
+	r.add(gvk, key, "b")
+	require.True(t, r.has(gvk, key))
+	require.False(t, r.has(schema.GroupVersionKind{Version: "v1", Kind: "Service"}, key))
+
+	_, version := r.snapshot()
+	require.Equal(t, []string{"a"}, r.stale(gvk, key, []string{"b", "c"}),
+		"organizations that lost the routing should be returned")
+	r.add(gvk, key, "b")
+	_, unchangedVersion := r.snapshot()
+	require.Equal(t, version, unchangedVersion, "the version should only change with the organizations")
+
+	r.remove(gvk, key, "a")
+	objects, newVersion := r.snapshot()
+	require.Equal(t, map[routedKey][]string{{gvk, key}: {"b"}}, objects)
+	require.Greater(t, newVersion, version)
+
+	r.remove(gvk, key, "b")
+	require.False(t, r.has(gvk, key), "objects should be forgotten once they are deleted from all organizations")
+
+	var disabled *routedOrganizations
+	disabled.add(gvk, key, "a")
+	require.False(t, disabled.has(gvk, key))
+	require.Empty(t, disabled.stale(gvk, key, nil))
+}
+
+func TestRoutedOrganizationsRestore(t *testing.T) {
+	r := newRoutedOrganizations()
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	pod := types.NamespacedName{Namespace: "default", Name: "pod"}
+	other := types.NamespacedName{Namespace: "default", Name: "other"}
+
+	r.add(gvk, pod, "a")
+	r.restore(map[routedKey][]string{
+		{gvk, pod}:   {"a", "b"},
+		{gvk, other}: {"c"},
+	})
+
+	objects, _ := r.snapshot()
+	require.Equal(t, map[routedKey][]string{
+		{gvk, pod}:   {"a", "b"},
+		{gvk, other}: {"c"},
+	}, objects)
+}
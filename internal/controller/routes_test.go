@@ -0,0 +1,206 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+func TestTargetOrganizations(t *testing.T) {
+	c := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "payments-prod",
+			Labels: map[string]string{"snyk-org": "payments"},
+		}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "ledger",
+			Annotations: map[string]string{"snyk.io/org-id": "ledger"},
+		}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "unknown",
+			Annotations: map[string]string{"snyk.io/org-id": "unknown"},
+		}},
+	).Build()
+
+	routes := newResourceRoutes([]config.Route{
+		{
+			OrganizationID:         "all",
+			Namespaces:             []string{"*"},
+			ExcludeNamespaces:      []string{"kube-*"},
+			ClusterScopedResources: true,
+		},
+		{OrganizationID: "teams", Namespaces: []string{"team-*-prod"}, ExcludeNamespaces: []string{"team-legacy-prod"}},
+		{OrganizationID: "previews", Namespaces: []string{"/preview-pr-[0-9]+/"}},
+		{OrganizationID: "default", Namespaces: []string{"default"}},
+		{
+			OrganizationID:    "payments",
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"snyk-org": "payments"}},
+		},
+		// routing a namespace by name and by selector should not route it twice.
+		{
+			OrganizationID:    "default",
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"snyk-org": "payments"}},
+		},
+		{OrganizationIDAnnotation: "snyk.io/org-id", AllowedOrganizationIDs: []string{"ledger", "payments"}},
+	}, schema.GroupResource{Resource: "pods"}, c)
+
+	for _, tc := range []struct {
+		name      string
+		namespace string
+		expected  []string
+	}{
+		{
+			name:      "cluster-scoped",
+			namespace: "",
+			expected:  []string{"all"},
+		},
+		{
+			name:      "namespace by name",
+			namespace: "default",
+			expected:  []string{"default", "all"},
+		},
+		{
+			name:      "namespace by selector",
+			namespace: "payments-prod",
+			expected:  []string{"all", "payments", "default"},
+		},
+		{
+			name:      "namespace by annotation",
+			namespace: "ledger",
+			expected:  []string{"all", "ledger"},
+		},
+		{
+			name:      "namespace by annotation that is not allowed",
+			namespace: "unknown",
+			expected:  []string{"all"},
+		},
+		{
+			name:      "namespace by glob",
+			namespace: "team-a-prod",
+			expected:  []string{"all", "teams"},
+		},
+		{
+			name:      "namespace by glob that is excluded",
+			namespace: "team-legacy-prod",
+			expected:  []string{"all"},
+		},
+		{
+			name:      "namespace by regular expression",
+			namespace: "preview-pr-42",
+			expected:  []string{"all", "previews"},
+		},
+		{
+			name:      "namespace by regular expression that does not match",
+			namespace: "preview-pr-42-old",
+			expected:  []string{"all"},
+		},
+		{
+			name:      "excluded namespace",
+			namespace: "kube-system",
+			expected:  []string{},
+		},
+		{
+			name:      "namespace that does not exist",
+			namespace: "deleted",
+			expected:  []string{"all"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: tc.namespace, Name: "obj"}}
+			orgs, err := routes.targetOrganizations(context.Background(), req)
+			require.NoError(t, err)
+			require.ElementsMatch(t, tc.expected, orgs)
+		})
+	}
+}
+
+func TestRouteTargets(t *testing.T) {
+	routes := []config.Route{
+		{OrganizationID: "platform", Namespaces: []string{"*"}, ClusterScopedResources: true},
+		{
+			OrganizationID:         "regulated",
+			Namespaces:             []string{"*"},
+			ClusterScopedResources: true,
+			Types: []config.RouteType{
+				{APIGroups: []string{"*"}, Resources: []string{"*"}, ExcludeResources: []string{"configmaps"}},
+			},
+			PathsToRemove: []string{"spec.containers.env"},
+		},
+		// removals of all routes of an organization are merged.
+		{
+			OrganizationID: "regulated",
+			Namespaces:     []string{"default"},
+			PathsToRemove:  []string{"metadata.annotations"},
+		},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		resource  schema.GroupResource
+		namespace string
+		expected  []target
+	}{
+		{
+			name:      "namespaced resource",
+			resource:  schema.GroupResource{Resource: "pods"},
+			namespace: "default",
+			expected: []target{
+				{orgID: "platform"},
+				{orgID: "regulated", pathsToRemove: []string{"spec.containers.env", "metadata.annotations"}},
+			},
+		},
+		{
+			name:      "cluster-scoped resource",
+			resource:  schema.GroupResource{Resource: "nodes"},
+			namespace: "",
+			expected: []target{
+				{orgID: "platform"},
+				{orgID: "regulated", pathsToRemove: []string{"spec.containers.env"}},
+			},
+		},
+		{
+			name:      "excluded resource",
+			resource:  schema.GroupResource{Resource: "configmaps"},
+			namespace: "other",
+			expected:  []target{{orgID: "platform"}},
+		},
+		{
+			name:      "unknown resource",
+			resource:  schema.GroupResource{},
+			namespace: "other",
+			expected:  []target{{orgID: "platform"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: tc.namespace, Name: "obj"}}
+			targets, err := newResourceRoutes(routes, tc.resource, nil).targets(context.Background(), req)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, targets)
+		})
+	}
+}
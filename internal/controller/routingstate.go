@@ -0,0 +1,363 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+	"github.com/snyk/kubernetes-scanner/internal/retry"
+)
+
+// routingStateKey is the key of the ConfigMap's binary data that holds the routing state.
+const routingStateKey = "state.json.gz"
+
+// routingStateSizeLimit is the maximum size of the data of a ConfigMap. A warning is logged once
+// the encoded routing state exceeds routingStateWarnRatio of it.
+var routingStateSizeLimit = 1024 * 1024
+
+const routingStateWarnRatio = 0.8
+
+// routingStateStore persists the routed organizations in a ConfigMap, so that objects are deleted
+// from organizations they are not routed to anymore, even if the routes changed while the scanner
+// was not running. The state is restored before any reconciler is started, and changes are
+// written periodically. It implements controller-runtime's Runnable interface.
+type routingStateStore struct {
+	// reader should not be cached, so that not all ConfigMaps of the cluster are watched.
+	reader   client.Reader
+	writer   client.Writer
+	key      types.NamespacedName
+	interval time.Duration
+	routed   *routedOrganizations
+	rs       *reconcilers
+	log      logr.Logger
+
+	// restored is closed once the state has been restored.
+	restored chan struct{}
+
+	// configMap is the ConfigMap as it has last been read or written. It is nil if it does not
+	// exist yet.
+	configMap *corev1.ConfigMap
+	// saved is the version of the routed organizations that has last been written.
+	saved uint64
+	// cfg is the config that objects which aren't reconciled have last been checked with.
+	cfg *config.Config
+}
+
+// Start restores the routing state and then writes changes to it every interval until the given
+// context is done.
+func (s *routingStateStore) Start(ctx context.Context) error {
+	if err := retry.Do(ctx, s.log, retry.Intervals(retry.Seconds(1, 2, 5, 10)), nil, func() error {
+		return s.restore(ctx)
+	}); err != nil {
+		return fmt.Errorf("could not restore routing state: %w", err)
+	}
+	close(s.restored)
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-s.rs.started:
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.deleteUnreconciled()
+
+		select {
+		case <-ctx.Done():
+			// changes since the last write should not be lost when the scanner shuts down.
+			saveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := s.save(saveCtx); err != nil {
+				s.log.Error(err, "could not save routing state")
+			}
+			return nil
+		case <-ticker.C:
+		}
+
+		if err := s.save(ctx); err != nil {
+			s.log.Error(err, "could not save routing state")
+		}
+	}
+}
+
+// NeedLeaderElection ensures that the routing state is only written by the elected leader.
+func (s *routingStateStore) NeedLeaderElection() bool {
+	return true
+}
+
+// restore reads the ConfigMap and merges its state into the routed organizations.
+func (s *routingStateStore) restore(ctx context.Context) error {
+	cm, err := s.read(ctx)
+	if err != nil {
+		return err
+	}
+	s.configMap = cm
+	if cm == nil {
+		return nil
+	}
+
+	objects, err := decodeRoutingState(cm.BinaryData[routingStateKey])
+	if err != nil {
+		// retrying won't help, so the state is overwritten with the next write.
+		s.log.Error(err, "discarding invalid routing state", "config_map", s.key)
+	} else {
+		s.routed.restore(objects)
+		s.log.Info("restored routing state", "config_map", s.key, "resources", len(objects))
+	}
+	return nil
+}
+
+// read returns the ConfigMap, or nil if it does not exist.
+func (s *routingStateStore) read(ctx context.Context) (*corev1.ConfigMap, error) {
+	cm := &corev1.ConfigMap{}
+	switch err := s.reader.Get(ctx, s.key, cm); {
+	case kerrors.IsNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("could not get config map %v: %w", s.key, err)
+	}
+	return cm, nil
+}
+
+// save writes the routed organizations to the ConfigMap if they changed since the last write.
+func (s *routingStateStore) save(ctx context.Context) error {
+	objects, version := s.routed.snapshot()
+	if version == s.saved {
+		return nil
+	}
+
+	data, err := encodeRoutingState(objects)
+	if err != nil {
+		return fmt.Errorf("could not encode routing state: %w", err)
+	}
+	switch size := len(data); {
+	case size > routingStateSizeLimit:
+		return fmt.Errorf("routing state of %d resources is too large to be written: %d bytes exceed the limit of %d bytes of config map %v",
+			len(objects), size, routingStateSizeLimit, s.key)
+	case float64(size) > routingStateWarnRatio*float64(routingStateSizeLimit):
+		s.log.Info("routing state is close to the size limit of config maps", "config_map", s.key,
+			"resources", len(objects), "bytes", size, "limit", routingStateSizeLimit)
+	}
+
+	cm, err := s.write(ctx, data)
+	if kerrors.IsConflict(err) || kerrors.IsAlreadyExists(err) {
+		// the ConfigMap has been written by someone else in the meantime, e.g. by a previous
+		// leader that was shutting down. As the state of this replica is the most recent one, the
+		// other state is overwritten rather than merged, which would bring back organizations that
+		// objects have been removed from since.
+		if s.configMap, err = s.read(ctx); err != nil {
+			return err
+		}
+		cm, err = s.write(ctx, data)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write config map %v: %w", s.key, err)
+	}
+
+	s.configMap = cm
+	s.saved = version
+	return nil
+}
+
+// write creates or updates the ConfigMap, depending on whether it existed when it has last been
+// read or written, and returns the written ConfigMap.
+func (s *routingStateStore) write(ctx context.Context, data []byte) (*corev1.ConfigMap, error) {
+	if s.configMap == nil {
+		cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: s.key.Name, Namespace: s.key.Namespace}}
+		cm.BinaryData = map[string][]byte{routingStateKey: data}
+		return cm, s.writer.Create(ctx, cm)
+	}
+
+	cm := s.configMap.DeepCopy()
+	cm.BinaryData = map[string][]byte{routingStateKey: data}
+	return cm, s.writer.Update(ctx, cm)
+}
+
+// deleteUnreconciled checks all routed objects that are not reconciled by any reconciler, and
+// deletes them from the organizations that they are not routed to anymore. Objects are not
+// reconciled if they have been deleted while the scanner was not running, or if their namespace is
+// ignored, e.g. because it isn't cached anymore after its routes have been removed. The check only
+// runs after the config changed.
+func (s *routingStateStore) deleteUnreconciled() {
+	cfg := s.rs.config()
+	if cfg == s.cfg {
+		return
+	}
+	s.cfg = cfg
+
+	type running struct {
+		ctx context.Context
+		*reconciler
+	}
+	reconcilers := map[schema.GroupVersionKind][]running{}
+	s.rs.each(func(ctx context.Context, r *reconciler) {
+		reconcilers[r.gvk.GroupVersionKind] = append(reconcilers[r.gvk.GroupVersionKind], running{ctx, r})
+	})
+
+	var enqueued, deleted int
+	for _, key := range s.routed.keys() {
+		// objects of types that are not scanned anymore are kept, in case they are scanned again.
+		candidates := reconcilers[key.gvk]
+		if len(candidates) == 0 {
+			continue
+		}
+
+		req := ctrl.Request{NamespacedName: key.NamespacedName}
+		i := slices.IndexFunc(candidates, func(r running) bool { return !r.isIgnored(req) })
+		if i < 0 {
+			r := candidates[0]
+			stale, err := r.deleteFromUnroutedOrganizations(r.ctx, req)
+			if err != nil {
+				s.log.Error(err, "could not delete resource from unrouted organizations", "gvk", key.gvk, "resource", req)
+			}
+			deleted += stale
+			continue
+		}
+
+		// objects that exist are reconciled anyway.
+		r := candidates[i]
+		ok, err := r.enqueueIfMissing(r.ctx, req)
+		if err != nil {
+			s.log.Error(err, "could not check for deleted resource", "gvk", key.gvk, "resource", req)
+		}
+		if ok {
+			enqueued++
+		}
+	}
+
+	s.log.Info("checked routing state for unreconciled resources", "enqueued", enqueued, "deleted", deleted)
+}
+
+// deleteFromUnroutedOrganizations deletes the object of the given request from all organizations
+// that it has been routed to, but isn't routed to anymore. It is used for objects that are ignored
+// by the reconciler and are therefore never reconciled. Returns the number of organizations that
+// the object is deleted from.
+func (r *reconciler) deleteFromUnroutedOrganizations(ctx context.Context, req ctrl.Request) (int, error) {
+	orgs, err := r.currentSettings().routes.targetOrganizations(ctx, req)
+	if err != nil {
+		return 0, fmt.Errorf("could not get target organizations: %w", err)
+	}
+
+	// the object is never sent to the organizations it is still routed to, so they are kept as is.
+	stale := r.routed.stale(r.gvk.GroupVersionKind, req.NamespacedName, orgs)
+	r.sent.retain(r.gvk.GroupVersionKind, req.NamespacedName, nil)
+	now := metav1.Now()
+	for _, orgID := range stale {
+		r.queueDeletion(orgID, r.newObject(req), now)
+	}
+	return len(stale), nil
+}
+
+// encodeRoutingState returns the gzip-compressed JSON of the given routed objects, which contains
+// the objects routed to each organization. Grouping the objects by organization keeps the state
+// small, as usually there are far less organizations than objects.
+func encodeRoutingState(objects map[routedKey][]string) ([]byte, error) {
+	byOrg := map[string][]string{}
+	for k, orgs := range objects {
+		for _, orgID := range orgs {
+			byOrg[orgID] = append(byOrg[orgID], k.String())
+		}
+	}
+	for _, keys := range byOrg {
+		slices.Sort(keys)
+	}
+
+	b, err := json.Marshal(byOrg)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal routing state: %w", err)
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, fmt.Errorf("could not compress routing state: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("could not compress routing state: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeRoutingState is the inverse of encodeRoutingState. Empty data results in an empty state.
+func decodeRoutingState(data []byte) (map[routedKey][]string, error) {
+	objects := map[routedKey][]string{}
+	if len(data) == 0 {
+		return objects, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress routing state: %w", err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress routing state: %w", err)
+	}
+
+	var byOrg map[string][]string
+	if err := json.Unmarshal(b, &byOrg); err != nil {
+		return nil, fmt.Errorf("could not unmarshal routing state: %w", err)
+	}
+
+	for orgID, keys := range byOrg {
+		for _, s := range keys {
+			k, err := parseRoutedKey(s)
+			if err != nil {
+				return nil, err
+			}
+			objects[k] = append(objects[k], orgID)
+		}
+	}
+	return objects, nil
+}
+
+// String returns the key in the format "group/version/kind/namespace/name". None of the parts can
+// contain a slash.
+func (k routedKey) String() string {
+	return strings.Join([]string{k.gvk.Group, k.gvk.Version, k.gvk.Kind, k.Namespace, k.Name}, "/")
+}
+
+func parseRoutedKey(s string) (routedKey, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 5 {
+		return routedKey{}, fmt.Errorf("invalid resource %q in routing state", s)
+	}
+	return routedKey{
+		gvk:            schema.GroupVersionKind{Group: parts[0], Version: parts[1], Kind: parts[2]},
+		NamespacedName: types.NamespacedName{Namespace: parts[3], Name: parts[4]},
+	}, nil
+}
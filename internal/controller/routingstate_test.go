@@ -0,0 +1,136 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRoutingStateEncoding(t *testing.T) {
+	pods := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	deployments := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	nodes := schema.GroupVersionKind{Version: "v1", Kind: "Node"}
+	objects := map[routedKey][]string{
+		{pods, types.NamespacedName{Namespace: "default", Name: "pod"}}:           {"a", "b"},
+		{deployments, types.NamespacedName{Namespace: "default", Name: "deploy"}}: {"b"},
+		{nodes, types.NamespacedName{Name: "node"}}:                               {"c"},
+	}
+
+	data, err := encodeRoutingState(objects)
+	require.NoError(t, err)
+
+	decoded, err := decodeRoutingState(data)
+	require.NoError(t, err)
+	require.Len(t, decoded, len(objects))
+	for k, orgs := range objects {
+		require.ElementsMatch(t, orgs, decoded[k])
+	}
+
+	decoded, err = decodeRoutingState(nil)
+	require.NoError(t, err)
+	require.Empty(t, decoded)
+
+	_, err = decodeRoutingState([]byte("invalid"))
+	require.Error(t, err)
+
+	_, err = parseRoutedKey("v1/Pod/default/pod")
+	require.Error(t, err)
+}
+
+func TestRoutingStateStore(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	key := types.NamespacedName{Namespace: "kubernetes-scanner", Name: "routing"}
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	pod := types.NamespacedName{Namespace: "default", Name: "pod"}
+
+	newStore := func() *routingStateStore {
+		return &routingStateStore{
+			reader: c,
+			writer: c,
+			key:    key,
+			routed: newRoutedOrganizations(),
+			log:    logr.Discard(),
+		}
+	}
+
+	// the ConfigMap is created on the first write.
+	s := newStore()
+	require.NoError(t, s.restore(ctx))
+	s.routed.add(gvk, pod, "a")
+	s.routed.add(gvk, pod, "b")
+	require.NoError(t, s.save(ctx))
+	require.NoError(t, c.Get(ctx, key, &corev1.ConfigMap{}))
+
+	restored := newStore()
+	require.NoError(t, restored.restore(ctx))
+	require.True(t, restored.routed.has(gvk, pod))
+	require.Equal(t, []string{"a"}, restored.routed.stale(gvk, pod, []string{"b"}),
+		"organizations that lost the routing while the scanner was restarted should be returned")
+	restored.routed.remove(gvk, pod, "a")
+	require.NoError(t, restored.save(ctx))
+
+	// the first store is outdated now. It overwrites the newer state without merging it, as it
+	// would otherwise bring back organizations that have been removed.
+	restored.routed.add(gvk, pod, "c")
+	require.NoError(t, restored.save(ctx))
+	other := types.NamespacedName{Namespace: "default", Name: "other"}
+	s.routed.add(gvk, other, "c")
+	require.NoError(t, s.save(ctx))
+	require.Empty(t, s.routed.stale(gvk, pod, []string{"a", "b"}),
+		"the state of the other writer should not have been merged")
+
+	restored = newStore()
+	require.NoError(t, restored.restore(ctx))
+	objects, _ := restored.routed.snapshot()
+	require.Len(t, objects, 2)
+	require.ElementsMatch(t, []string{"a", "b"}, objects[routedKey{gvk, pod}])
+	require.Equal(t, []string{"c"}, objects[routedKey{gvk, other}])
+}
+
+func TestRoutingStateStoreSizeLimit(t *testing.T) {
+	limit := routingStateSizeLimit
+	routingStateSizeLimit = 64
+	t.Cleanup(func() { routingStateSizeLimit = limit })
+
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	s := &routingStateStore{
+		reader: c,
+		writer: c,
+		key:    types.NamespacedName{Namespace: "kubernetes-scanner", Name: "routing"},
+		routed: newRoutedOrganizations(),
+		log:    logr.Discard(),
+	}
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	for i := 0; i < 100; i++ {
+		s.routed.add(gvk, types.NamespacedName{Namespace: "default", Name: fmt.Sprintf("pod-%d", i)}, "a")
+	}
+
+	err := s.save(ctx)
+	require.ErrorContains(t, err, "too large")
+	require.True(t, kerrors.IsNotFound(c.Get(ctx, s.key, &corev1.ConfigMap{})), "the config map should not have been written")
+}
@@ -0,0 +1,91 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+// cacheSelectors returns the cache options that restrict the informers of the given scan types to
+// the objects matching their selectors. As the informer of a GVK is shared between all scan types,
+// it is only restricted if all scan types of the GVK use the same selectors.
+func cacheSelectors(scanTypes map[reconcilerKey]config.ScanType) map[client.Object]cache.ByObject {
+	byGVK := map[schema.GroupVersionKind][]config.ScanType{}
+	for key, scanType := range scanTypes {
+		byGVK[key.gvk.GroupVersionKind] = append(byGVK[key.gvk.GroupVersionKind], scanType)
+	}
+
+	byObject := map[client.Object]cache.ByObject{}
+	for gvk, all := range byGVK {
+		first := all[0]
+		if first.LabelSelector == "" && first.FieldSelector == "" {
+			continue
+		}
+
+		same := true
+		for _, other := range all[1:] {
+			if other.LabelSelector != first.LabelSelector || other.FieldSelector != first.FieldSelector {
+				same = false
+			}
+		}
+		if !same {
+			continue
+		}
+
+		// the selectors have been validated when reading the config.
+		label, field, err := first.Selectors()
+		if err != nil {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gvk)
+		byObject[obj] = cache.ByObject{Label: label, Field: field}
+	}
+	return byObject
+}
+
+// matchesSelectors returns true if the given object matches the label and field selector. Nil
+// selectors match everything.
+func matchesSelectors(obj *unstructured.Unstructured, label labels.Selector, field fields.Selector) bool {
+	if label != nil && !label.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+
+	if field == nil || field.Empty() {
+		return true
+	}
+
+	set := fields.Set{}
+	for _, req := range field.Requirements() {
+		value, found, err := unstructured.NestedFieldNoCopy(obj.Object, strings.Split(req.Field, ".")...)
+		if err != nil || !found || value == nil {
+			continue
+		}
+		set[req.Field] = fmt.Sprint(value)
+	}
+	return field.Matches(set)
+}
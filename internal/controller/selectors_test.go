@@ -0,0 +1,105 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+func TestMatchesSelectors(t *testing.T) {
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":      "pod",
+			"namespace": "default",
+			"labels": map[string]interface{}{
+				"team":                         "payments",
+				"app.kubernetes.io/managed-by": "Helm",
+			},
+		},
+		"spec":   map[string]interface{}{"nodeName": "node-1"},
+		"status": map[string]interface{}{"phase": "Running"},
+	}}
+
+	for _, tc := range []struct {
+		name          string
+		labelSelector string
+		fieldSelector string
+		expected      bool
+	}{
+		{
+			name:     "no selectors",
+			expected: true,
+		},
+		{
+			name:          "matching label selector",
+			labelSelector: "team in (payments, ledger)",
+			expected:      true,
+		},
+		{
+			name:          "non-matching label selector",
+			labelSelector: "app.kubernetes.io/managed-by!=Helm",
+			expected:      false,
+		},
+		{
+			name:          "matching field selector",
+			fieldSelector: "metadata.name=pod,metadata.namespace=default",
+			expected:      true,
+		},
+		{
+			name:          "non-matching field selector",
+			fieldSelector: "metadata.namespace!=default",
+			expected:      false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			scanType := config.ScanType{LabelSelector: tc.labelSelector, FieldSelector: tc.fieldSelector}
+			label, field, err := scanType.Selectors()
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, matchesSelectors(pod, label, field))
+		})
+	}
+}
+
+func TestCacheSelectors(t *testing.T) {
+	pods := config.GroupVersionKind{GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "Pod"}}
+	services := config.GroupVersionKind{GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "Service"}}
+	configMaps := config.GroupVersionKind{GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}}
+
+	byObject := cacheSelectors(map[reconcilerKey]config.ScanType{
+		// the same selectors for all scan types of pods.
+		{scanType: 0, gvk: pods}: {LabelSelector: "team=payments"},
+		{scanType: 1, gvk: pods}: {LabelSelector: "team=payments"},
+		// different selectors for services.
+		{scanType: 0, gvk: services}: {LabelSelector: "team=payments"},
+		{scanType: 1, gvk: services}: {},
+		// no selectors for config maps.
+		{scanType: 1, gvk: configMaps}: {},
+	})
+
+	require.Len(t, byObject, 1)
+	for obj, opts := range byObject {
+		require.Equal(t, pods.GroupVersionKind, obj.GetObjectKind().GroupVersionKind())
+		require.Equal(t, "team=payments", opts.Label.String())
+	}
+}
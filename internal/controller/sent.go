@@ -0,0 +1,230 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/slices"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/snyk/kubernetes-scanner/internal/backend"
+)
+
+var skippedUnchangedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "kubernetes_scanner",
+	Name:      "unchanged_resources_skipped_total",
+	Help:      "The number of resources that have not been sent as they did not change since they were last sent.",
+})
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(skippedUnchangedTotal)
+}
+
+// upsert is a resource that is queued to be sent to the backend, along with the hash of its
+// manifest.
+type upsert struct {
+	backend.Resource
+	hash [sha256.Size]byte
+	// done is called once the batch of the upsert has been sent, or has finally failed. It is
+	// optional.
+	done func(error)
+}
+
+// resourcesOf returns the resources of the given upserts.
+func resourcesOf(upserts []upsert) []backend.Resource {
+	resources := make([]backend.Resource, len(upserts))
+	for i, u := range upserts {
+		resources[i] = u.Resource
+	}
+	return resources
+}
+
+// partitionUpserts splits the upserts into the ones whose manifest is part of the given resources,
+// and all others.
+func partitionUpserts(upserts []upsert, resources []backend.Resource) (in, out []upsert) {
+	manifests := make(map[client.Object]bool, len(resources))
+	for _, res := range resources {
+		manifests[res.ManifestBlob] = true
+	}
+	for _, u := range upserts {
+		if manifests[u.ManifestBlob] {
+			in = append(in, u)
+		} else {
+			out = append(out, u)
+		}
+	}
+	return in, out
+}
+
+type sentKey struct {
+	orgID string
+	gvk   schema.GroupVersionKind
+	types.NamespacedName
+}
+
+func newSentKey(orgID string, obj client.Object) sentKey {
+	return sentKey{
+		orgID:          orgID,
+		gvk:            obj.GetObjectKind().GroupVersionKind(),
+		NamespacedName: client.ObjectKeyFromObject(obj),
+	}
+}
+
+// objectKey identifies an object regardless of the organizations it is sent to.
+type objectKey struct {
+	gvk schema.GroupVersionKind
+	types.NamespacedName
+}
+
+func newObjectKey(obj client.Object) objectKey {
+	return objectKey{
+		gvk:            obj.GetObjectKind().GroupVersionKind(),
+		NamespacedName: client.ObjectKeyFromObject(obj),
+	}
+}
+
+type sentEntry struct {
+	hash   [sha256.Size]byte
+	sentAt time.Time
+}
+
+// sentResources keeps track of the manifests that have been sent successfully to each
+// organization, so that resources that did not change don't have to be sent again. Unchanged
+// resources are still sent once resendAfter has passed. A nil *sentResources never skips
+// resources.
+type sentResources struct {
+	resendAfter time.Duration
+
+	lock sync.Mutex
+	// entries holds the sent manifests of each object by organization.
+	entries map[objectKey]map[string]sentEntry
+}
+
+func newSentResources(resendAfter time.Duration) *sentResources {
+	return &sentResources{
+		resendAfter: resendAfter,
+		entries:     map[objectKey]map[string]sentEntry{},
+	}
+}
+
+// for testing.
+var now = time.Now
+
+// unchanged returns true if the object with the given hash has already been sent to the
+// organization within the resend interval.
+func (s *sentResources) unchanged(orgID string, obj client.Object, hash [sha256.Size]byte) bool {
+	if s == nil {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.entries[newObjectKey(obj)][orgID]
+	return ok && entry.hash == hash && now().Sub(entry.sentAt) < s.resendAfter
+}
+
+// excludedHash is the hash of deletions of objects that still exist, but are excluded from
+// scanning, e.g. because they opted out. These deletions are recorded like any other upsert, so
+// that they are only sent once.
+var excludedHash = sha256.Sum256([]byte("excluded"))
+
+// record records the given upserts as successfully sent to the organization. Deleted resources are
+// forgotten, unless they are only excluded from scanning.
+func (s *sentResources) record(orgID string, upserts []upsert) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sentAt := now()
+	for _, u := range upserts {
+		key := newObjectKey(u.ManifestBlob)
+		if u.DeletedAt != nil && u.hash != excludedHash {
+			s.forgetOrganization(key, orgID)
+			continue
+		}
+		if s.entries[key] == nil {
+			s.entries[key] = map[string]sentEntry{}
+		}
+		s.entries[key][orgID] = sentEntry{hash: u.hash, sentAt: sentAt}
+	}
+}
+
+// retain forgets the given object for all organizations but the given ones. It needs to be called
+// whenever the object is not sent to an organization anymore, so that it is sent again once it
+// becomes eligible, even if it did not change in the meantime.
+func (s *sentResources) retain(gvk schema.GroupVersionKind, name types.NamespacedName, orgs []string) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := objectKey{gvk: gvk, NamespacedName: name}
+	for orgID := range s.entries[key] {
+		if !slices.Contains(orgs, orgID) {
+			s.forgetOrganization(key, orgID)
+		}
+	}
+}
+
+// forgetKind forgets all objects of the given GVK, e.g. because its reconciler has been stopped.
+func (s *sentResources) forgetKind(gvk schema.GroupVersionKind) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key := range s.entries {
+		if key.gvk == gvk {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// forgetOrganization forgets the object of the given key for the organization. s.lock must be held.
+func (s *sentResources) forgetOrganization(key objectKey, orgID string) {
+	delete(s.entries[key], orgID)
+	if len(s.entries[key]) == 0 {
+		delete(s.entries, key)
+	}
+}
+
+// hashObject returns the hash of the object's contents.
+func hashObject(obj *unstructured.Unstructured) ([sha256.Size]byte, error) {
+	// maps are marshalled with sorted keys, so the result is stable.
+	b, err := json.Marshal(obj.Object)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("could not marshal object: %w", err)
+	}
+	return sha256.Sum256(b), nil
+}
@@ -0,0 +1,128 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/snyk/kubernetes-scanner/internal/backend"
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+func TestSentResources(t *testing.T) {
+	current := time.Unix(1000, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace("default")
+	pod.SetName("pod")
+	hash, err := hashObject(pod)
+	require.NoError(t, err)
+
+	s := newSentResources(time.Hour)
+	require.False(t, s.unchanged("org", pod, hash), "resource has not been sent yet")
+
+	s.record("org", []upsert{{Resource: backend.Resource{ManifestBlob: pod}, hash: hash}})
+	require.True(t, s.unchanged("org", pod, hash))
+	require.False(t, s.unchanged("other-org", pod, hash), "resource has not been sent to this org")
+
+	changed := pod.DeepCopy()
+	changed.SetLabels(map[string]string{"foo": "bar"})
+	changedHash, err := hashObject(changed)
+	require.NoError(t, err)
+	require.False(t, s.unchanged("org", changed, changedHash))
+
+	current = current.Add(time.Hour)
+	require.False(t, s.unchanged("org", pod, hash), "unchanged resource needs to be resent")
+
+	s.record("org", []upsert{{Resource: backend.Resource{ManifestBlob: pod}, hash: hash}})
+	require.True(t, s.unchanged("org", pod, hash))
+	s.record("org", []upsert{{Resource: backend.Resource{ManifestBlob: pod, DeletedAt: &metav1.Time{Time: current}}}})
+	require.False(t, s.unchanged("org", pod, hash), "deleted resource should have been forgotten")
+
+	s.record("org", []upsert{{Resource: backend.Resource{ManifestBlob: pod}, hash: hash}})
+	s.record("other-org", []upsert{{Resource: backend.Resource{ManifestBlob: pod}, hash: hash}})
+	s.retain(pod.GroupVersionKind(), client.ObjectKeyFromObject(pod), []string{"other-org"})
+	require.False(t, s.unchanged("org", pod, hash), "resource should have been forgotten for unretained orgs")
+	require.True(t, s.unchanged("other-org", pod, hash))
+
+	s.forgetKind(pod.GroupVersionKind())
+	require.False(t, s.unchanged("other-org", pod, hash), "resources of the kind should have been forgotten")
+	require.Empty(t, s.entries)
+
+	var disabled *sentResources
+	disabled.record("org", []upsert{{Resource: backend.Resource{ManifestBlob: pod}, hash: hash}})
+	require.False(t, disabled.unchanged("org", pod, hash))
+}
+
+func TestReconcileForgetsResourcesThatAreNotSent(t *testing.T) {
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "pod"}}
+	key := objectKey{gvk: schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, NamespacedName: req.NamespacedName}
+
+	for _, tc := range []struct {
+		name  string
+		setup func(t *testing.T, r *reconciler)
+	}{
+		{
+			name: "namespace ignored",
+			setup: func(t *testing.T, r *reconciler) {
+				matcher, err := config.ScanType{Namespaces: []string{"other"}}.NamespaceMatcher()
+				require.NoError(t, err)
+				r.namespaces = matcher
+			},
+		},
+		{
+			name: "not routed",
+			setup: func(t *testing.T, r *reconciler) {
+				routes := []config.Route{{OrganizationID: "org", Namespaces: []string{"other"}}}
+				r.settings.routes = newResourceRoutes(routes, schema.GroupResource{Resource: "pods"}, r.cache)
+			},
+		},
+		{
+			name: "routed to another organization",
+			setup: func(t *testing.T, r *reconciler) {
+				routes := []config.Route{{OrganizationID: "other-org", Namespaces: []string{"*"}}}
+				r.settings.routes = newResourceRoutes(routes, schema.GroupResource{Resource: "pods"}, r.cache)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: req.Name, Namespace: req.Namespace}}
+			r, _ := newTestReconciler(t, "org", pod)
+			r.sent = newSentResources(time.Hour)
+			r.sent.entries[key] = map[string]sentEntry{"org": {sentAt: now()}}
+			tc.setup(t, r)
+
+			_, err := r.Reconcile(context.Background(), req)
+			require.NoError(t, err)
+			require.NotContains(t, r.sent.entries, key, "the resource should be sent again once it becomes eligible")
+		})
+	}
+}
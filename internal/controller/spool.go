@@ -0,0 +1,246 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/snyk/kubernetes-scanner/internal/backend"
+	"github.com/snyk/kubernetes-scanner/internal/config"
+	"github.com/snyk/kubernetes-scanner/internal/spool"
+)
+
+// spooler stores batches that could not be sent in a spool on disk, and sends them again once the
+// backend recovers. A nil *spooler drops failed batches. It implements controller-runtime's
+// Runnable interface.
+type spooler struct {
+	spool       *spool.Spool
+	store       Store
+	interval    time.Duration
+	maxInterval time.Duration
+	log         logr.Logger
+
+	lock sync.Mutex
+	// sentAt holds the newest scan time of each resource that has been sent successfully while the
+	// spool is not empty. Spooled resources that have been sent again since are not replayed, so
+	// that older states never overwrite newer ones.
+	sentAt map[sentKey]metav1.Time
+}
+
+func newSpooler(cfg config.Spool, store Store, logger logr.Logger) (*spooler, error) {
+	s, err := spool.New(spool.Config{
+		Dir:      cfg.Directory,
+		MaxBytes: cfg.MaxBytes,
+		MaxAge:   cfg.MaxAge.Duration,
+		Eviction: spool.EvictionPolicy(cfg.EvictionPolicy),
+	}, ctrlmetrics.Registry)
+	if err != nil {
+		return nil, fmt.Errorf("could not create spool: %w", err)
+	}
+
+	return &spooler{
+		spool:       s,
+		store:       store,
+		interval:    cfg.ReplayInterval.Duration,
+		maxInterval: cfg.MaxReplayInterval.Duration,
+		log:         logger,
+		sentAt:      map[sentKey]metav1.Time{},
+	}, nil
+}
+
+// spooledBatch is a batch of resources as it is stored in the spool.
+type spooledBatch struct {
+	OrgID     string            `json:"orgID"`
+	Resources []spooledResource `json:"resources"`
+}
+
+// spooledResource is a backend.Resource with a concrete type for its manifest, so that it can be
+// decoded again.
+type spooledResource struct {
+	ManifestBlob     *unstructured.Unstructured `json:"manifest_blob"`
+	PreferredVersion string                     `json:"preferred_version"`
+	ScannedAt        metav1.Time                `json:"scanned_at"`
+	DeletedAt        *metav1.Time               `json:"deleted_at,omitempty"`
+}
+
+// push stores a batch that could not be sent.
+func (s *spooler) push(orgID string, resources []backend.Resource) error {
+	if s == nil {
+		return nil
+	}
+
+	// the manifests are marshaled the same way, no matter their concrete type.
+	data, err := json.Marshal(struct {
+		OrgID     string             `json:"orgID"`
+		Resources []backend.Resource `json:"resources"`
+	}{orgID, resources})
+	if err != nil {
+		return fmt.Errorf("could not marshal batch: %w", err)
+	}
+
+	if err := s.spool.Push(data); err != nil {
+		return fmt.Errorf("could not spool batch: %w", err)
+	}
+	return nil
+}
+
+// record records resources that have been sent successfully.
+func (s *spooler) record(orgID string, resources []backend.Resource) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// only resources that might be spooled need to be known.
+	if s.spool.Len() == 0 {
+		if len(s.sentAt) > 0 {
+			s.sentAt = map[sentKey]metav1.Time{}
+		}
+		return
+	}
+
+	for _, res := range resources {
+		key := newSentKey(orgID, res.ManifestBlob)
+		if sentAt, ok := s.sentAt[key]; !ok || sentAt.Before(&res.ScannedAt) {
+			s.sentAt[key] = res.ScannedAt
+		}
+	}
+}
+
+// Start sends spooled batches every interval until the given context is done. After failures, the
+// interval is doubled up to the max interval.
+func (s *spooler) Start(ctx context.Context) error {
+	interval := s.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+
+		if err := s.replay(ctx); err != nil {
+			interval = min(2*interval, s.maxInterval)
+			s.log.Error(err, "could not send spooled batches", "retry_in", interval.String(),
+				"spooled_batches", s.spool.Len())
+			continue
+		}
+		interval = s.interval
+	}
+}
+
+// NeedLeaderElection ensures that spooled batches are only sent by the elected leader.
+func (s *spooler) NeedLeaderElection() bool {
+	return true
+}
+
+// replay sends the spooled batches, oldest first, until the spool is empty or sending fails.
+func (s *spooler) replay(ctx context.Context) error {
+	for ctx.Err() == nil {
+		entry, data, ok, err := s.spool.Peek()
+		if err != nil || !ok {
+			return err
+		}
+
+		var batch spooledBatch
+		if err := json.Unmarshal(data, &batch); err != nil {
+			s.log.Error(err, "dropping spooled batch that can't be decoded", "entry", entry.ID)
+			if err := s.spool.Remove(entry.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		resources := s.outstanding(batch)
+		if len(resources) > 0 {
+			requestID := uuid.New().String()
+			s.log.Info("sending spooled batch", "organization_id", batch.OrgID, "request_id", requestID,
+				"batch_size", len(resources), "spooled_at", entry.Created)
+			err := s.store.Upsert(ctx, requestID, batch.OrgID, resources)
+			var oversized *backend.OversizedError
+			switch {
+			case err == nil:
+				s.record(batch.OrgID, resources)
+			case errors.As(err, &oversized):
+				// all other resources of the batch have been sent.
+				s.log.Error(err, "dropping spooled resources that are too large", "entry", entry.ID,
+					"organization_id", batch.OrgID, "request_id", requestID)
+				sent := make([]backend.Resource, 0, len(resources))
+				for _, res := range resources {
+					if !oversized.Contains(res.ManifestBlob) {
+						sent = append(sent, res)
+					}
+				}
+				s.record(batch.OrgID, sent)
+			case backend.Retryable(err):
+				// resources that have been sent, or are too large to be sent, are skipped when the
+				// batch is sent again.
+				var partial *backend.PartialError
+				if errors.As(err, &partial) {
+					s.record(batch.OrgID, partial.Sent)
+					s.record(batch.OrgID, partial.Oversized)
+				}
+				return fmt.Errorf("could not upsert spooled batch: %w", err)
+			default:
+				// the backend rejects the batch, no matter how often it is sent.
+				s.log.Error(err, "dropping spooled batch that can't be sent", "entry", entry.ID,
+					"organization_id", batch.OrgID, "request_id", requestID)
+			}
+		}
+
+		if err := s.spool.Remove(entry.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outstanding returns the resources of the batch that have not been sent in a newer state since
+// the batch was spooled.
+func (s *spooler) outstanding(batch spooledBatch) []backend.Resource {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var resources []backend.Resource
+	for _, res := range batch.Resources {
+		if res.ManifestBlob == nil {
+			continue
+		}
+		sentAt, ok := s.sentAt[newSentKey(batch.OrgID, res.ManifestBlob)]
+		if ok && !sentAt.Before(&res.ScannedAt) {
+			continue
+		}
+		resources = append(resources, backend.Resource{
+			ManifestBlob:     res.ManifestBlob,
+			PreferredVersion: res.PreferredVersion,
+			ScannedAt:        res.ScannedAt,
+			DeletedAt:        res.DeletedAt,
+		})
+	}
+	return resources
+}
@@ -0,0 +1,101 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/snyk/kubernetes-scanner/internal/backend"
+	"github.com/snyk/kubernetes-scanner/internal/spool"
+)
+
+// failingStore fails all upserts with its error until it is unset.
+type failingStore struct {
+	*fakeBackend
+	err error
+}
+
+func (f *failingStore) Upsert(ctx context.Context, requestID string, orgID string, resources []backend.Resource) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.fakeBackend.Upsert(ctx, requestID, orgID, resources)
+}
+
+func newTestResource(name string, scannedAt metav1.Time) backend.Resource {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Pod")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	return backend.Resource{ManifestBlob: obj, PreferredVersion: "v1", ScannedAt: scannedAt}
+}
+
+func TestSpoolerReplay(t *testing.T) {
+	ctx := context.Background()
+	s, err := spool.New(spool.Config{Dir: t.TempDir(), MaxBytes: 1 << 20}, prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	store := &failingStore{fakeBackend: newFakeBackend(), err: errors.New("backend unavailable")}
+	sp := &spooler{spool: s, store: store, log: logr.Discard(), sentAt: map[sentKey]metav1.Time{}}
+
+	spooledAt := metav1.NewTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	updated := newTestResource("updated", spooledAt)
+	stale := newTestResource("stale", spooledAt)
+	require.NoError(t, sp.push("org", []backend.Resource{updated, stale}))
+	require.Equal(t, 1, s.Len())
+
+	// a newer state of one of the spooled resources is sent in the meantime.
+	sp.record("org", []backend.Resource{newTestResource("updated", metav1.Now())})
+
+	require.Error(t, sp.replay(ctx))
+	require.Equal(t, 1, s.Len(), "batches that could not be sent should be kept")
+
+	store.err = nil
+	require.NoError(t, sp.replay(ctx))
+	require.Equal(t, 0, s.Len())
+	require.Equal(t, map[resourceIdentifier]int{
+		newResourceID(stale.ManifestBlob, "org"): 1,
+	}, store.reconciliations, "resources that have been sent since should not be replayed")
+
+	store.err = &backend.HTTPError{StatusCode: 400}
+	require.NoError(t, sp.push("org", []backend.Resource{newTestResource("rejected", spooledAt)}))
+	require.NoError(t, sp.replay(ctx))
+	require.Equal(t, 0, s.Len(), "batches that the backend rejects should be dropped")
+
+	// resources of partially sent batches are not sent again.
+	partial, failed := newTestResource("partial", spooledAt), newTestResource("failed", spooledAt)
+	store.err = &backend.PartialError{Sent: []backend.Resource{partial}, Err: errors.New("backend unavailable")}
+	require.NoError(t, sp.push("org", []backend.Resource{partial, failed}))
+	require.Error(t, sp.replay(ctx))
+	store.err = nil
+	require.NoError(t, sp.replay(ctx))
+	require.Contains(t, store.reconciliations, newResourceID(failed.ManifestBlob, "org"))
+	require.NotContains(t, store.reconciliations, newResourceID(partial.ManifestBlob, "org"))
+
+	var nilSpooler *spooler
+	require.NoError(t, nilSpooler.push("org", []backend.Resource{stale}))
+	nilSpooler.record("org", []backend.Resource{stale})
+}
@@ -0,0 +1,79 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+// tombstones holds the last known state of objects that have been deleted, until their deletion
+// has been reconciled.
+type tombstones struct {
+	lock    sync.Mutex
+	objects map[types.NamespacedName]*unstructured.Unstructured
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{objects: map[types.NamespacedName]*unstructured.Unstructured{}}
+}
+
+func (t *tombstones) add(obj *unstructured.Unstructured) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.objects[client.ObjectKeyFromObject(obj)] = obj
+}
+
+// pop returns and removes the last known state of the given object. Returns nil if there is none.
+func (t *tombstones) pop(key types.NamespacedName) *unstructured.Unstructured {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	obj := t.objects[key]
+	delete(t.objects, key)
+	return obj
+}
+
+// recordTombstones wraps an event handler and records the last known state of deleted objects,
+// as received from the informer, before the deletion is enqueued.
+type recordTombstones struct {
+	handler.EventHandler
+	tombstones *tombstones
+}
+
+func (h recordTombstones) Delete(ctx context.Context, e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+	// the object is shared with the informer and must not be modified.
+	switch obj := e.Object.(type) {
+	case *unstructured.Unstructured:
+		h.tombstones.add(obj.DeepCopy())
+
+	case *metav1.PartialObjectMetadata:
+		// for metadata-only informers, the metadata is all we know about the object.
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err == nil {
+			h.tombstones.add(&unstructured.Unstructured{Object: content})
+		}
+	}
+	h.EventHandler.Delete(ctx, e, q)
+}
@@ -0,0 +1,66 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+func TestRecordTombstones(t *testing.T) {
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer q.ShutDown()
+
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace("default")
+	pod.SetName("pod")
+	pod.SetUID("1234")
+	pod.SetLabels(map[string]string{"app": "payments"})
+
+	h := recordTombstones{EventHandler: &handler.EnqueueRequestForObject{}, tombstones: newTombstones()}
+	h.Delete(context.Background(), event.DeleteEvent{Object: pod}, q)
+
+	require.Equal(t, 1, q.Len())
+	item, _ := q.Get()
+	require.Equal(t, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "pod"}}, item)
+
+	key := types.NamespacedName{Namespace: "default", Name: "pod"}
+	tombstone := h.tombstones.pop(key)
+	require.Equal(t, pod, tombstone)
+	require.NotSame(t, pod, tombstone, "the informer's object must not be shared")
+	require.Nil(t, h.tombstones.pop(key), "tombstones should only be returned once")
+
+	metadata := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "pod",
+		UID:       "1234",
+	}}
+	h.Delete(context.Background(), event.DeleteEvent{Object: metadata}, q)
+	tombstone = h.tombstones.pop(key)
+	require.NotNil(t, tombstone)
+	require.Equal(t, types.UID("1234"), tombstone.GetUID())
+}
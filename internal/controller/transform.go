@@ -0,0 +1,112 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slices"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+	"github.com/snyk/kubernetes-scanner/internal/kubeobjects"
+)
+
+const managedFieldsPath = "metadata.managedFields"
+
+// cacheTransform removes the configured attributes from objects before they are stored in the
+// informer cache, so that they never occupy any memory. As objects are always fetched from the API
+// server when they are scanned, this only affects the cached copies.
+type cacheTransform struct {
+	lock     sync.RWMutex
+	removals map[schema.GroupVersionKind][]string
+}
+
+// update sets the removals from the given scan types. If multiple scan types contain the same GVK,
+// only the attributes that are removed by all of them are removed from the cache, as the others
+// might still be relevant for the update predicates of the other scan types.
+func (t *cacheTransform) update(scanTypes map[reconcilerKey]config.ScanType) {
+	if t == nil {
+		return
+	}
+
+	removals := map[schema.GroupVersionKind][]string{}
+	for key, scanType := range scanTypes {
+		gvk := key.gvk.GroupVersionKind
+		if _, ok := removals[gvk]; !ok {
+			removals[gvk] = slices.Clone(scanType.PathsToRemove)
+			continue
+		}
+
+		var common []string
+		for _, path := range removals[gvk] {
+			if slices.Contains(scanType.PathsToRemove, path) {
+				common = append(common, path)
+			}
+		}
+		removals[gvk] = common
+	}
+
+	// the opt-out and the routing of objects read the labels and annotations of namespaces from
+	// the cache, so they are only removed when namespaces are scanned.
+	if paths, ok := removals[namespaceGVK]; ok {
+		var kept []string
+		for _, path := range paths {
+			if !removesNamespaceMetadata(path) {
+				kept = append(kept, path)
+			}
+		}
+		removals[namespaceGVK] = kept
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.removals = removals
+}
+
+// removesNamespaceMetadata returns true if the given path removes the labels or annotations of
+// namespaces.
+func removesNamespaceMetadata(path string) bool {
+	for _, field := range []string{"metadata.labels", "metadata.annotations"} {
+		if path == "metadata" || path == field || strings.HasPrefix(path, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// transform implements controller-runtime's cache.TransformFunc.
+func (t *cacheTransform) transform(in interface{}) (interface{}, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	switch obj := in.(type) {
+	case *unstructured.Unstructured:
+		for _, path := range t.removals[obj.GroupVersionKind()] {
+			kubeobjects.RemoveAttributes(obj, path)
+		}
+
+	case *metav1.PartialObjectMetadata:
+		// the managed fields are the only configurable removal that is relevant for metadata.
+		if slices.Contains(t.removals[obj.GroupVersionKind()], managedFieldsPath) {
+			obj.SetManagedFields(nil)
+		}
+	}
+	return in, nil
+}
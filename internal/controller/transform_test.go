@@ -0,0 +1,137 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/snyk/kubernetes-scanner/internal/config"
+)
+
+func TestCacheTransform(t *testing.T) {
+	podGVK := config.GroupVersionKind{GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "Pod"}}
+	cmGVK := config.GroupVersionKind{GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}}
+
+	transform := &cacheTransform{}
+	transform.update(map[reconcilerKey]config.ScanType{
+		{scanType: 0, gvk: podGVK}: {PathsToRemove: []string{"metadata.managedFields", "spec.containers.env"}},
+		{scanType: 1, gvk: podGVK}: {PathsToRemove: []string{"metadata.managedFields"}},
+		{scanType: 1, gvk: cmGVK}:  {PathsToRemove: []string{"metadata.managedFields", "data"}},
+	})
+
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":          "pod",
+			"managedFields": []interface{}{map[string]interface{}{"manager": "kubectl"}},
+		},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{map[string]interface{}{
+				"name": "app",
+				"env":  []interface{}{map[string]interface{}{"name": "FOO", "value": "bar"}},
+			}},
+		},
+	}}
+	out, err := transform.transform(pod)
+	require.NoError(t, err)
+	// only the removals that all scan types of the GVK share are applied.
+	require.Equal(t, &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "pod"},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{map[string]interface{}{
+				"name": "app",
+				"env":  []interface{}{map[string]interface{}{"name": "FOO", "value": "bar"}},
+			}},
+		},
+	}}, out)
+
+	cm := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:          "cm",
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+	}
+	out, err = transform.transform(cm)
+	require.NoError(t, err)
+	require.Empty(t, out.(*metav1.PartialObjectMetadata).ManagedFields)
+
+	// objects of other types are not modified.
+	other := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":          "secret",
+			"managedFields": []interface{}{map[string]interface{}{"manager": "kubectl"}},
+		},
+	}}
+	out, err = transform.transform(other.DeepCopy())
+	require.NoError(t, err)
+	require.Equal(t, other, out)
+}
+
+func TestCacheTransformKeepsNamespaceMetadata(t *testing.T) {
+	transform := &cacheTransform{}
+	transform.update(map[reconcilerKey]config.ScanType{
+		{scanType: 0, gvk: config.GroupVersionKind{GroupVersionKind: namespaceGVK}}: {
+			PathsToRemove: []string{"metadata.managedFields", "metadata.labels", "metadata.annotations"},
+		},
+	})
+
+	meta := metav1.ObjectMeta{
+		Name:          "sandbox",
+		Labels:        map[string]string{"team": "payments"},
+		Annotations:   map[string]string{optOutAnnotation: optOutValue},
+		ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+	}
+	ns := &metav1.PartialObjectMetadata{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"}, ObjectMeta: meta}
+	out, err := transform.transform(ns)
+	require.NoError(t, err)
+	// the labels and annotations are needed for the opt-out and the routing of objects.
+	require.Equal(t, meta.Labels, out.(*metav1.PartialObjectMetadata).Labels)
+	require.Equal(t, meta.Annotations, out.(*metav1.PartialObjectMetadata).Annotations)
+	require.Empty(t, out.(*metav1.PartialObjectMetadata).ManagedFields)
+
+	full := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata": map[string]interface{}{
+			"name":          "sandbox",
+			"labels":        map[string]interface{}{"team": "payments"},
+			"annotations":   map[string]interface{}{optOutAnnotation: optOutValue},
+			"managedFields": []interface{}{map[string]interface{}{"manager": "kubectl"}},
+		},
+	}}
+	out, err = transform.transform(full)
+	require.NoError(t, err)
+	require.Equal(t, &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata": map[string]interface{}{
+			"name":        "sandbox",
+			"labels":      map[string]interface{}{"team": "payments"},
+			"annotations": map[string]interface{}{optOutAnnotation: optOutValue},
+		},
+	}}, out)
+}
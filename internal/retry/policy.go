@@ -0,0 +1,66 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// for testing.
+var (
+	now    = time.Now
+	random = rand.Float64
+)
+
+// Policy decides whether and when a failed attempt is retried.
+type Policy interface {
+	// Next returns the delay before the next attempt, given the number of retries so far and the
+	// time elapsed since the first attempt. Returns false if no more attempts should be made.
+	Next(retries int, elapsed time.Duration) (time.Duration, bool)
+}
+
+// Intervals is a policy that retries once for each of its intervals, waiting the interval before
+// the attempt.
+type Intervals []time.Duration
+
+func (i Intervals) Next(retries int, _ time.Duration) (time.Duration, bool) {
+	if retries >= len(i) {
+		return 0, false
+	}
+	return i[retries], true
+}
+
+// Exponential is a policy that multiplies the delay with every retry, up to a maximum.
+type Exponential struct {
+	// Initial is the delay before the first retry.
+	Initial time.Duration
+	// Max is the maximum delay before a retry, not considering jitter. Zero means no maximum.
+	Max time.Duration
+	// Multiplier is the factor that the delay grows by with every retry. Values below 1 are
+	// treated as 1.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction of it in either direction, so that
+	// clients that failed at the same time don't retry at the same time. It should be between 0
+	// and 1.
+	Jitter float64
+	// MaxElapsedTime is the time after the first attempt after which no more attempts are made.
+	// Zero means no limit.
+	MaxElapsedTime time.Duration
+}
+
+func (e Exponential) Next(retries int, elapsed time.Duration) (time.Duration, bool) {
+	delay := float64(e.Initial) * math.Pow(math.Max(e.Multiplier, 1), float64(retries))
+	if e.Max > 0 {
+		delay = math.Min(delay, float64(e.Max))
+	}
+	delay *= 1 + e.Jitter*(2*random()-1)
+
+	d := time.Duration(math.MaxInt64)
+	if delay < math.MaxInt64 {
+		d = time.Duration(delay)
+	}
+	if e.MaxElapsedTime > 0 && d > e.MaxElapsedTime-elapsed {
+		return 0, false
+	}
+	return d, true
+}
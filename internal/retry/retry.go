@@ -1,6 +1,9 @@
 package retry
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -14,19 +17,68 @@ func Seconds(seconds ...int) []time.Duration {
 	return times
 }
 
+// Retry calls the worker until it succeeds, waiting the given intervals between the attempts. It
+// does not stop on context cancellation; use Do for that.
 func Retry(
 	logger logr.Logger,
 	intervals []time.Duration,
 	worker func() error,
 ) error {
-	for _, interval := range intervals {
-		if err := worker(); err != nil {
-			logger.Error(err, "retrying after error")
-			time.Sleep(interval)
-		} else {
+	return Do(context.Background(), logger, Intervals(intervals), nil, worker)
+}
+
+// After is implemented by errors that know how long to wait at least before the failed attempt
+// is retried, e.g. because the server asked to retry after some time.
+type After interface {
+	RetryAfter() time.Duration
+}
+
+// Classifier returns true if an attempt that failed with the given error should be retried.
+type Classifier func(error) bool
+
+// Do calls the worker until it succeeds, the error is not retryable according to the classifier,
+// the policy gives up or the context is done. A nil classifier retries all errors. Errors that
+// implement After delay the next attempt accordingly, as long as the policy would still retry by
+// then. Returns the error of the last attempt, which wraps the context's error if the context is
+// done.
+func Do(
+	ctx context.Context,
+	logger logr.Logger,
+	policy Policy,
+	retryable Classifier,
+	worker func() error,
+) error {
+	start := now()
+	for retries := 0; ; retries++ {
+		err := worker()
+		if err == nil {
 			return nil
 		}
+		if retryable != nil && !retryable(err) {
+			return err
+		}
+
+		elapsed := now().Sub(start)
+		delay, ok := policy.Next(retries, elapsed)
+		if !ok {
+			return err
+		}
+		var after After
+		if errors.As(err, &after) && after.RetryAfter() > delay {
+			wait := after.RetryAfter()
+			if _, ok := policy.Next(retries, elapsed+wait-delay); !ok {
+				return err
+			}
+			delay = wait
+		}
+		logger.Error(err, "retrying after error", "retry_in", delay.String())
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-timer.C:
+		}
 	}
-	// Need a final attempt after the last interval.
-	return worker()
 }
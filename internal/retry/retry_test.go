@@ -1,8 +1,12 @@
 package retry
 
 import (
+	"context"
 	"errors"
+	"math"
+	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr/testr"
 	"github.com/stretchr/testify/require"
@@ -40,3 +44,143 @@ func TestRetryFails(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, calls, 3)
 }
+
+func TestDoNotRetryable(t *testing.T) {
+	calls := 0
+	errPermanent := errors.New("permanent")
+	err := Do(context.Background(), testr.New(t), Intervals(Seconds(0, 0)), func(err error) bool {
+		return !errors.Is(err, errPermanent)
+	}, func() error {
+		calls++
+		if calls >= 2 {
+			return errPermanent
+		}
+		return errors.New("boom")
+	})
+	require.ErrorIs(t, err, errPermanent)
+	require.Equal(t, 2, calls)
+}
+
+func TestDoContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	done := make(chan error)
+	go func() {
+		done <- Do(ctx, testr.New(t), Intervals(Seconds(60)), nil, func() error {
+			calls++
+			return errors.New("boom")
+		})
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+		require.ErrorContains(t, err, "boom")
+		require.Equal(t, 1, calls)
+	case <-time.After(5 * time.Second):
+		t.Fatal("retrying should stop once the context is cancelled")
+	}
+}
+
+type afterError time.Duration
+
+func (e afterError) Error() string             { return "throttled" }
+func (e afterError) RetryAfter() time.Duration { return time.Duration(e) }
+
+func TestDoRetryAfter(t *testing.T) {
+	policy := Exponential{Initial: time.Millisecond, MaxElapsedTime: time.Hour}
+
+	calls := 0
+	start := time.Now()
+	err := Do(context.Background(), testr.New(t), policy, nil, func() error {
+		calls++
+		if calls >= 2 {
+			return nil
+		}
+		return afterError(50 * time.Millisecond)
+	})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond, "the requested delay should be honored")
+
+	calls = 0
+	err = Do(context.Background(), testr.New(t), policy, nil, func() error {
+		calls++
+		return afterError(2 * time.Hour)
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls, "attempts that the policy would not make anymore should not be waited for")
+}
+
+func TestExponential(t *testing.T) {
+	defer func() { random = rand.Float64 }()
+
+	for _, tc := range []struct {
+		name    string
+		policy  Exponential
+		random  float64
+		retries int
+		elapsed time.Duration
+		delay   time.Duration
+		stop    bool
+	}{
+		{
+			name:   "first retry",
+			policy: Exponential{Initial: time.Second, Multiplier: 2},
+			random: 0.5,
+			delay:  time.Second,
+		},
+		{
+			name:    "grows with every retry",
+			policy:  Exponential{Initial: time.Second, Multiplier: 2},
+			random:  0.5,
+			retries: 3,
+			delay:   8 * time.Second,
+		},
+		{
+			name:    "max delay",
+			policy:  Exponential{Initial: time.Second, Multiplier: 2, Max: 5 * time.Second},
+			random:  0.5,
+			retries: 3,
+			delay:   5 * time.Second,
+		},
+		{
+			name:    "unbounded delay",
+			policy:  Exponential{Initial: time.Second, Multiplier: 2},
+			random:  0.5,
+			retries: 1000,
+			delay:   math.MaxInt64,
+		},
+		{
+			name:    "lower jitter",
+			policy:  Exponential{Initial: time.Second, Multiplier: 2, Jitter: 0.5},
+			random:  0,
+			retries: 1,
+			delay:   time.Second,
+		},
+		{
+			name:    "upper jitter",
+			policy:  Exponential{Initial: time.Second, Multiplier: 2, Jitter: 0.5},
+			random:  1,
+			retries: 1,
+			delay:   3 * time.Second,
+		},
+		{
+			name:    "max elapsed time",
+			policy:  Exponential{Initial: time.Second, Multiplier: 2, MaxElapsedTime: time.Minute},
+			random:  0.5,
+			retries: 2,
+			elapsed: 57 * time.Second,
+			stop:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			random = func() float64 { return tc.random }
+			delay, ok := tc.policy.Next(tc.retries, tc.elapsed)
+			require.Equal(t, !tc.stop, ok)
+			if ok {
+				require.Equal(t, tc.delay, delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sharding distributes namespaces between multiple replicas of the scanner. Every replica
+// announces itself through a Lease object that it keeps renewing; all replicas with a valid Lease
+// form the shard group. Namespaces are assigned to members through rendezvous hashing, which is
+// deterministic across replicas and only moves the namespaces of members that join or leave.
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/exp/slices"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// GroupLabel is the label that is set on all Leases of a shard group, with the group's name as its
+// value.
+const GroupLabel = "kubernetes-scanner.snyk.io/shard-group"
+
+type Config struct {
+	// Group is the name of the shard group. All replicas with the same group share the work.
+	Group string
+	// Identity uniquely identifies this replica within the group, e.g. the pod name.
+	Identity string
+	// Namespace is the namespace the Leases are created in.
+	Namespace string
+	// LeaseDuration is the time after which a replica that did not renew its Lease is considered
+	// gone.
+	LeaseDuration time.Duration
+	// RenewInterval is the interval in which the Lease is renewed and the members are refreshed.
+	RenewInterval time.Duration
+}
+
+// Sharder keeps track of the members of a shard group and decides which namespaces are owned by
+// this replica. It implements controller-runtime's Runnable interface.
+type Sharder struct {
+	client client.Client
+	config Config
+	log    logr.Logger
+
+	lock    sync.RWMutex
+	members []string
+
+	changed chan struct{}
+}
+
+func New(c client.Client, cfg Config, log logr.Logger) *Sharder {
+	return &Sharder{
+		client:  c,
+		config:  cfg,
+		log:     log.WithValues("shard_group", cfg.Group, "shard_identity", cfg.Identity),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// for testing.
+var now = time.Now
+
+// Owns returns true if the given namespace is assigned to this replica. Cluster-scoped resources
+// are identified by the empty namespace and are owned by a single replica as well. Until the
+// members of the group are known, no namespace is owned.
+func (s *Sharder) Owns(namespace string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return owner(s.members, namespace) == s.config.Identity
+}
+
+// Changed returns a channel that receives a value whenever the members of the group, and thus the
+// assignment of namespaces, changed. Notifications are coalesced, the channel has a single
+// consumer.
+func (s *Sharder) Changed() <-chan struct{} {
+	return s.changed
+}
+
+// Start keeps renewing this replica's Lease and refreshing the group members until the context is
+// done. On shutdown, the Lease is deleted so that the other members can take over immediately.
+func (s *Sharder) Start(ctx context.Context) error {
+	ticker := time.NewTicker(s.config.RenewInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.renew(ctx); err != nil {
+			s.log.Error(err, "could not renew shard lease")
+		} else if err := s.refreshMembers(ctx); err != nil {
+			s.log.Error(err, "could not refresh shard members")
+		}
+
+		select {
+		case <-ctx.Done():
+			s.release()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection returns false as all replicas are active when sharding.
+func (s *Sharder) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *Sharder) leaseName() string {
+	return s.config.Group + "-" + s.config.Identity
+}
+
+func (s *Sharder) renew(ctx context.Context) error {
+	renewTime := metav1.NewMicroTime(now())
+	leaseSeconds := int32(s.config.LeaseDuration.Seconds())
+
+	lease := &coordinationv1.Lease{}
+	err := s.client.Get(ctx, client.ObjectKey{Namespace: s.config.Namespace, Name: s.leaseName()}, lease)
+	switch {
+	case kerrors.IsNotFound(err):
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.leaseName(),
+				Namespace: s.config.Namespace,
+				Labels:    map[string]string{GroupLabel: s.config.Group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.config.Identity,
+				LeaseDurationSeconds: &leaseSeconds,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}
+		if err := s.client.Create(ctx, lease); err != nil {
+			return fmt.Errorf("could not create lease: %w", err)
+		}
+		return nil
+
+	case err != nil:
+		return fmt.Errorf("could not get lease: %w", err)
+	}
+
+	lease.Spec.HolderIdentity = &s.config.Identity
+	lease.Spec.LeaseDurationSeconds = &leaseSeconds
+	lease.Spec.RenewTime = &renewTime
+	if err := s.client.Update(ctx, lease); err != nil {
+		return fmt.Errorf("could not update lease: %w", err)
+	}
+	return nil
+}
+
+func (s *Sharder) refreshMembers(ctx context.Context) error {
+	leases := &coordinationv1.LeaseList{}
+	if err := s.client.List(ctx, leases,
+		client.InNamespace(s.config.Namespace),
+		client.MatchingLabels{GroupLabel: s.config.Group},
+	); err != nil {
+		return fmt.Errorf("could not list leases: %w", err)
+	}
+
+	var members []string
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		if lease.Spec.HolderIdentity == nil {
+			continue
+		}
+
+		if !isExpired(lease) {
+			members = append(members, *lease.Spec.HolderIdentity)
+			continue
+		}
+
+		// Leases of replicas that are gone are cleaned up by the remaining members. Should the
+		// replica still be around, it will simply re-create its lease.
+		if err := s.client.Delete(ctx, lease); err != nil && !kerrors.IsNotFound(err) {
+			s.log.Error(err, "could not delete expired shard lease", "lease", lease.Name)
+		}
+	}
+	slices.Sort(members)
+
+	s.lock.Lock()
+	changed := !slices.Equal(s.members, members)
+	s.members = members
+	s.lock.Unlock()
+
+	if changed {
+		s.log.Info("shard members changed", "members", members)
+		select {
+		case s.changed <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *Sharder) release() {
+	// the context passed to Start is already done at this point.
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.RenewInterval)
+	defer cancel()
+
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: s.config.Namespace, Name: s.leaseName()},
+	}
+	if err := s.client.Delete(ctx, lease); err != nil && !kerrors.IsNotFound(err) {
+		s.log.Error(err, "could not release shard lease")
+	}
+}
+
+func isExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return now().After(expiry)
+}
+
+// owner returns the member that owns the given namespace, using rendezvous (highest random
+// weight) hashing. Returns the empty string if there are no members.
+func owner(members []string, namespace string) string {
+	var (
+		maxWeight uint64
+		owner     string
+	)
+	for _, member := range members {
+		h := fnv.New64a()
+		// writes to a hash never return an error.
+		_, _ = h.Write([]byte(member))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(namespace))
+		if weight := mix(h.Sum64()); owner == "" || weight > maxWeight {
+			maxWeight = weight
+			owner = member
+		}
+	}
+	return owner
+}
+
+// mix is the finalizer of MurmurHash3. FNV alone does not spread inputs that only differ in their
+// last bytes well enough, which would skew the distribution of namespaces.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
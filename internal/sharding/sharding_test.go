@@ -0,0 +1,122 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestOwnerDistribution(t *testing.T) {
+	members := []string{"scanner-a", "scanner-b", "scanner-c"}
+	owned := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		owned[owner(members, fmt.Sprintf("namespace-%d", i))]++
+	}
+
+	for _, member := range members {
+		// we expect roughly a third for each member.
+		require.InDelta(t, 1000, owned[member], 150, "member %v owns %v namespaces", member, owned[member])
+	}
+}
+
+func TestOwnerRebalancing(t *testing.T) {
+	before := []string{"scanner-a", "scanner-b", "scanner-c"}
+	after := []string{"scanner-a", "scanner-c"}
+	for i := 0; i < 1000; i++ {
+		ns := fmt.Sprintf("namespace-%d", i)
+		// only the namespaces of the member that left should move.
+		if o := owner(before, ns); o != "scanner-b" {
+			require.Equal(t, o, owner(after, ns))
+		}
+	}
+
+	require.Equal(t, "", owner(nil, "namespace"))
+}
+
+func TestMembers(t *testing.T) {
+	ctx := context.Background()
+	now = func() time.Time { return time.Unix(1000, 0) }
+	defer func() { now = time.Now }()
+
+	c := fake.NewClientBuilder().WithObjects(
+		newLease("scanners-alive", "scanners", "alive", time.Unix(995, 0)),
+		newLease("scanners-dead", "scanners", "dead", time.Unix(900, 0)),
+		newLease("others-alive", "others", "other-alive", time.Unix(995, 0)),
+	).Build()
+
+	s := New(c, Config{
+		Group:         "scanners",
+		Identity:      "me",
+		Namespace:     "scanner-ns",
+		LeaseDuration: 15 * time.Second,
+		RenewInterval: 5 * time.Second,
+	}, testr.New(t))
+	require.False(t, s.Owns(""), "no namespace should be owned before the members are known")
+
+	require.NoError(t, s.renew(ctx))
+	require.NoError(t, s.refreshMembers(ctx))
+	require.Equal(t, []string{"alive", "me"}, s.members)
+
+	select {
+	case <-s.Changed():
+	default:
+		t.Fatalf("expected a notification about changed members")
+	}
+
+	// the expired lease of the dead member should have been cleaned up.
+	leases := &coordinationv1.LeaseList{}
+	require.NoError(t, c.List(ctx, leases, client.InNamespace("scanner-ns")))
+	require.Len(t, leases.Items, 3)
+
+	// a second refresh without any changes must not notify.
+	require.NoError(t, s.refreshMembers(ctx))
+	select {
+	case <-s.Changed():
+		t.Fatalf("did not expect a notification")
+	default:
+	}
+
+	s.release()
+	require.NoError(t, c.List(ctx, leases, client.InNamespace("scanner-ns")))
+	require.Len(t, leases.Items, 2)
+}
+
+func newLease(name, group, identity string, renewed time.Time) *coordinationv1.Lease {
+	renewTime := metav1.NewMicroTime(renewed)
+	seconds := int32(15)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "scanner-ns",
+			Labels:    map[string]string{GroupLabel: group},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &identity,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &renewTime,
+		},
+	}
+}
@@ -0,0 +1,345 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package spool implements a durable first-in-first-out queue of entries in a directory, which is
+// bounded by the total size and the age of its entries.
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// EvictionPolicy defines which entries are dropped once the spool is full.
+type EvictionPolicy string
+
+const (
+	// EvictOldest drops the oldest entries to make room for new ones.
+	EvictOldest EvictionPolicy = "dropOldest"
+	// RejectNewest keeps the existing entries and rejects new ones.
+	RejectNewest EvictionPolicy = "rejectNewest"
+)
+
+// ErrFull is returned when an entry is rejected because the spool is full.
+var ErrFull = errors.New("spool is full")
+
+const fileSuffix = ".entry"
+
+type Config struct {
+	// Dir is the directory the entries are stored in. It is created if it does not exist.
+	Dir string
+	// MaxBytes is the maximum total size of all entries.
+	MaxBytes int64
+	// MaxAge is the age after which entries are dropped. Zero keeps entries forever.
+	MaxAge time.Duration
+	// Eviction defines what happens if a new entry does not fit into the spool anymore.
+	Eviction EvictionPolicy
+}
+
+// Entry is an entry of the spool.
+type Entry struct {
+	// ID identifies the entry, e.g. to remove it.
+	ID      string
+	Size    int64
+	Created time.Time
+}
+
+// Spool is a durable queue of entries. Entries are stored as files in the spool directory, so
+// that they survive restarts. It is safe for concurrent use.
+type Spool struct {
+	config Config
+
+	lock    sync.Mutex
+	entries []Entry
+	bytes   int64
+	// seq distinguishes entries that are created at the same time.
+	seq uint64
+
+	*metrics
+}
+
+// for testing.
+var now = time.Now
+
+// New creates a spool in the configured directory. Entries that already exist in the directory,
+// e.g. from before a restart, are part of the spool.
+func New(config Config, reg prometheus.Registerer) (*Spool, error) {
+	if config.MaxBytes <= 0 {
+		return nil, fmt.Errorf("max bytes must be positive")
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %w", err)
+	}
+
+	s := &Spool{config: config, metrics: newMetrics(reg)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.updateMetrics()
+	return s, nil
+}
+
+// load reads the entries of the spool directory.
+func (s *Spool) load() error {
+	files, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return fmt.Errorf("could not read spool directory: %w", err)
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		path := filepath.Join(s.config.Dir, f.Name())
+		// temporary files are left behind if writing an entry has been interrupted.
+		if !strings.HasSuffix(f.Name(), fileSuffix) {
+			if strings.HasSuffix(f.Name(), ".tmp") {
+				_ = os.Remove(path)
+			}
+			continue
+		}
+
+		created, seq, ok := parseName(f.Name())
+		if !ok {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return fmt.Errorf("could not stat spool entry %v: %w", f.Name(), err)
+		}
+
+		s.entries = append(s.entries, Entry{ID: f.Name(), Size: info.Size(), Created: created})
+		s.bytes += info.Size()
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+	}
+
+	// the names sort by creation time.
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].ID < s.entries[j].ID })
+	return nil
+}
+
+// Push adds a new entry with the given data. If the spool is full, entries are evicted according to
+// the eviction policy. Returns ErrFull if the entry is rejected.
+func (s *Spool) Push(data []byte) error {
+	size := int64(len(data))
+	if size > s.config.MaxBytes {
+		s.evicted.WithLabelValues("size").Inc()
+		return fmt.Errorf("entry of %d bytes exceeds the spool size: %w", size, ErrFull)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer s.updateMetrics()
+
+	s.expire()
+	for s.bytes+size > s.config.MaxBytes {
+		if s.config.Eviction == RejectNewest {
+			s.evicted.WithLabelValues("size").Inc()
+			return ErrFull
+		}
+		if err := s.remove(s.entries[0].ID); err != nil {
+			return err
+		}
+		s.evicted.WithLabelValues("size").Inc()
+	}
+
+	created := now()
+	name := fmt.Sprintf("%020d-%020d%s", created.UnixNano(), s.seq, fileSuffix)
+	s.seq++
+
+	// entries are written to a temporary file first, so that partially written entries are never
+	// read.
+	path := filepath.Join(s.config.Dir, name)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		_ = os.Remove(path + ".tmp")
+		return fmt.Errorf("could not write spool entry: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		_ = os.Remove(path + ".tmp")
+		return fmt.Errorf("could not write spool entry: %w", err)
+	}
+
+	s.entries = append(s.entries, Entry{ID: name, Size: size, Created: created})
+	s.bytes += size
+	return nil
+}
+
+// Peek returns the oldest entry and its data, without removing it. Returns false if the spool is
+// empty.
+func (s *Spool) Peek() (Entry, []byte, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer s.updateMetrics()
+
+	s.expire()
+	if len(s.entries) == 0 {
+		return Entry{}, nil, false, nil
+	}
+
+	e := s.entries[0]
+	data, err := os.ReadFile(filepath.Join(s.config.Dir, e.ID))
+	if err != nil {
+		return Entry{}, nil, false, fmt.Errorf("could not read spool entry %v: %w", e.ID, err)
+	}
+	return e, data, true, nil
+}
+
+// Remove removes the entry with the given ID. Removing an entry that does not exist is not an
+// error.
+func (s *Spool) Remove(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer s.updateMetrics()
+	return s.remove(id)
+}
+
+// Len returns the number of entries.
+func (s *Spool) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.entries)
+}
+
+// remove removes the entry with the given ID. s.lock must be held.
+func (s *Spool) remove(id string) error {
+	for i, e := range s.entries {
+		if e.ID != id {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.config.Dir, id)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove spool entry %v: %w", id, err)
+		}
+		s.entries = append(s.entries[:i], s.entries[i+1:]...)
+		s.bytes -= e.Size
+		return nil
+	}
+	return nil
+}
+
+// expire drops all entries that are older than the max age. s.lock must be held.
+func (s *Spool) expire() {
+	if s.config.MaxAge <= 0 {
+		return
+	}
+
+	for len(s.entries) > 0 && now().Sub(s.entries[0].Created) > s.config.MaxAge {
+		// if the entry can't be removed, it is dropped from the spool anyway and removed from
+		// the directory with the next restart at the latest.
+		e := s.entries[0]
+		_ = os.Remove(filepath.Join(s.config.Dir, e.ID))
+		s.entries = s.entries[1:]
+		s.bytes -= e.Size
+		s.evicted.WithLabelValues("age").Inc()
+	}
+}
+
+// parseName returns the creation time and sequence number of the entry with the given file name.
+func parseName(name string) (time.Time, uint64, bool) {
+	nano, seq, ok := strings.Cut(strings.TrimSuffix(name, fileSuffix), "-")
+	if !ok {
+		return time.Time{}, 0, false
+	}
+	n, err := strconv.ParseInt(nano, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	sq, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return time.Unix(0, n), sq, true
+}
+
+type metrics struct {
+	entries prometheus.Gauge
+	bytes   prometheus.Gauge
+	evicted *prometheus.CounterVec
+	// oldest is the creation time of the oldest entry in unix nanoseconds, or zero if the spool
+	// is empty.
+	oldest    atomic.Int64
+	oldestAge *prometheus.Desc
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		entries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "kubernetes_scanner",
+			Name:      "spool_entries",
+			Help:      "The number of batches in the spool that are waiting to be sent again",
+		}),
+		bytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "kubernetes_scanner",
+			Name:      "spool_bytes",
+			Help:      "The total size of all batches in the spool",
+		}),
+		evicted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "kubernetes_scanner",
+			Name:      "spool_evicted_total",
+			Help:      "The number of batches that have been dropped from or rejected by the spool, partitioned by the limit that was hit",
+		}, []string{"reason"}),
+		oldestAge: prometheus.NewDesc(
+			"kubernetes_scanner_spool_oldest_entry_age_seconds",
+			"Age of the oldest batch in the spool in seconds, or zero if the spool is empty",
+			nil, nil,
+		),
+	}
+	reg.MustRegister(m)
+	return m
+}
+
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	age := float64(0)
+	if oldest := m.oldest.Load(); oldest != 0 {
+		age = now().Sub(time.Unix(0, oldest)).Seconds()
+	}
+
+	ch <- prometheus.MustNewConstMetric(m.oldestAge, prometheus.GaugeValue, age)
+
+	m.entries.Collect(ch)
+	m.bytes.Collect(ch)
+	m.evicted.Collect(ch)
+}
+
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.oldestAge
+
+	m.entries.Describe(ch)
+	m.bytes.Describe(ch)
+	m.evicted.Describe(ch)
+}
+
+// updateMetrics updates the metrics with the current entries of the spool. s.lock must be held.
+func (s *Spool) updateMetrics() {
+	s.metrics.entries.Set(float64(len(s.entries)))
+	s.metrics.bytes.Set(float64(s.bytes))
+	if len(s.entries) > 0 {
+		s.metrics.oldest.Store(s.entries[0].Created.UnixNano())
+	} else {
+		s.metrics.oldest.Store(0)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * © 2023 Snyk Limited
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package spool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSpool(t *testing.T, config Config) *Spool {
+	t.Helper()
+	s, err := New(config, prometheus.NewRegistry())
+	require.NoError(t, err)
+	return s
+}
+
+// peek returns the data of the oldest entry.
+func peek(t *testing.T, s *Spool) (Entry, string) {
+	t.Helper()
+	e, data, ok, err := s.Peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	return e, string(data)
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSpool(t, Config{Dir: dir, MaxBytes: 100})
+
+	_, _, ok, err := s.Peek()
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, s.Push([]byte("first")))
+	require.NoError(t, s.Push([]byte("second")))
+	require.Equal(t, 2, s.Len())
+
+	e, data := peek(t, s)
+	require.Equal(t, "first", data)
+	require.EqualValues(t, 5, e.Size)
+	require.NoError(t, s.Remove(e.ID))
+
+	// entries survive restarts, and leftovers of interrupted writes are removed.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "interrupted"+fileSuffix+".tmp"), []byte("x"), 0o600))
+	s = newTestSpool(t, Config{Dir: dir, MaxBytes: 100})
+	require.Equal(t, 1, s.Len())
+	require.NoFileExists(t, filepath.Join(dir, "interrupted"+fileSuffix+".tmp"))
+
+	require.NoError(t, s.Push([]byte("third")))
+	e, data = peek(t, s)
+	require.Equal(t, "second", data)
+	require.NoError(t, s.Remove(e.ID))
+	e, data = peek(t, s)
+	require.Equal(t, "third", data)
+	require.NoError(t, s.Remove(e.ID))
+	require.Equal(t, 0, s.Len())
+}
+
+func TestSpoolEviction(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		eviction EvictionPolicy
+		rejected bool
+		oldest   string
+	}{
+		{
+			name:     "drop oldest",
+			eviction: EvictOldest,
+			rejected: false,
+			oldest:   "bbbb",
+		},
+		{
+			name:     "reject newest",
+			eviction: RejectNewest,
+			rejected: true,
+			oldest:   "aaaa",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestSpool(t, Config{Dir: t.TempDir(), MaxBytes: 10, Eviction: tc.eviction})
+			require.NoError(t, s.Push([]byte("aaaa")))
+			require.NoError(t, s.Push([]byte("bbbb")))
+
+			err := s.Push([]byte("cccc"))
+			if tc.rejected {
+				require.True(t, errors.Is(err, ErrFull))
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, 2, s.Len())
+			_, data := peek(t, s)
+			require.Equal(t, tc.oldest, data)
+			require.Equal(t, float64(1), testutil.ToFloat64(s.evicted.WithLabelValues("size")))
+
+			require.ErrorIs(t, s.Push(make([]byte, 11)), ErrFull, "entries larger than the spool are always rejected")
+		})
+	}
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	s := newTestSpool(t, Config{Dir: t.TempDir(), MaxBytes: 100, MaxAge: time.Hour})
+	require.NoError(t, s.Push([]byte("old")))
+	current = current.Add(45 * time.Minute)
+	require.NoError(t, s.Push([]byte("new")))
+
+	expected := `
+# HELP kubernetes_scanner_spool_oldest_entry_age_seconds Age of the oldest batch in the spool in seconds, or zero if the spool is empty
+# TYPE kubernetes_scanner_spool_oldest_entry_age_seconds gauge
+kubernetes_scanner_spool_oldest_entry_age_seconds 2700
+`
+	require.NoError(t, testutil.CollectAndCompare(s.metrics, strings.NewReader(expected),
+		"kubernetes_scanner_spool_oldest_entry_age_seconds"))
+
+	current = current.Add(30 * time.Minute)
+	_, data := peek(t, s)
+	require.Equal(t, "new", data, "expired entries should be dropped")
+	require.Equal(t, 1, s.Len())
+	require.Equal(t, float64(1), testutil.ToFloat64(s.evicted.WithLabelValues("age")))
+}